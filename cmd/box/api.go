@@ -1,45 +1,75 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mkuznets/classbox/pkg/api"
+	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/mkuznets/classbox/pkg/opts"
+	"github.com/mkuznets/classbox/pkg/storage"
 	"github.com/mkuznets/classbox/pkg/utils"
 )
 
-var maxTime = time.Date(2999, time.December, 31, 0, 0, 0, 0, time.UTC)
-
 // APICommand with command line flags and env
 type APICommand struct {
-	Env      *opts.Env       `group:"Environment" namespace:"env" env-namespace:"ENV"`
-	Addr     string          `long:"addr" env:"ADDR" description:"HTTP service address" default:"127.0.0.1:8080"`
-	WebURL   string          `long:"web-url" env:"WEB_URL" description:"url to website" required:"true"`
-	Deadline string          `long:"deadline" env:"DEADLINE" description:"submission deadline"`
-	DB       *opts.DB        `group:"PostgreSQL" namespace:"db" env-namespace:"DB"`
-	Github   *opts.Github    `group:"github" namespace:"github" env-namespace:"GITHUB"`
-	AWS      *opts.AWS       `group:"AWS" namespace:"aws" env-namespace:"AWS"`
-	Jwt      *opts.JwtServer `group:"JWT" namespace:"jwt" env-namespace:"JWT"`
-	Sentry   *opts.Sentry    `group:"Sentry" namespace:"sentry" env-namespace:"SENTRY"`
+	Env       *opts.Env       `group:"Environment" namespace:"env" env-namespace:"ENV"`
+	Addr      string          `long:"addr" env:"ADDR" description:"HTTP service address" default:"127.0.0.1:8080"`
+	WebURL    string          `long:"web-url" env:"WEB_URL" description:"url to website" required:"true"`
+	Deadline  string          `long:"deadline" env:"DEADLINE" description:"deprecated: submission deadline (RFC 3339) of courses without deadlines"`
+	Lease     time.Duration   `long:"task-lease" env:"TASK_LEASE" description:"time until a task of unresponsive runner is re-enqueued" default:"2m"`
+	Retries   int             `long:"task-retries" env:"TASK_RETRIES" description:"how many times a task can be re-enqueued" default:"2"`
+	Supersede bool            `long:"supersede" env:"SUPERSEDE" description:"skip enqueued commits of a user once they push a newer one"`
+	Branches  []string        `long:"push-branch" env:"PUSH_BRANCHES" env-delim:"," description:"grade pushes to the branch instead of check suites"`
+	Pulls     bool            `long:"pull-requests" env:"PULL_REQUESTS" description:"grade pull requests into enrolled repositories"`
+	Reviews   bool            `long:"pr-review" env:"PR_REVIEW" description:"review pull requests with failed tests"`
+	CheckRuns string          `long:"check-runs" env:"CHECK_RUNS" description:"report results in a Github check run per commit, or also per test or topic" choice:"commit" choice:"test" choice:"topic" default:"commit"` // nolint
+	Reruns    int             `long:"rerun-limit" env:"RERUN_LIMIT" description:"how many times per hour a user can re-run their commits" default:"5"`
+	Quotas    []string        `long:"quota" env:"QUOTAS" env-delim:"," description:"max graded commits of a user per period, e.g. 10/1h"`
+	DB        *opts.DB        `group:"PostgreSQL" namespace:"db" env-namespace:"DB"`
+	Github    *opts.Github    `group:"github" namespace:"github" env-namespace:"GITHUB"`
+	Storage   *opts.Storage   `group:"Storage" namespace:"storage" env-namespace:"STORAGE"`
+	AWS       *opts.AWS       `group:"AWS" namespace:"aws" env-namespace:"AWS"`
+	Jwt       *opts.JwtServer `group:"JWT" namespace:"jwt" env-namespace:"JWT"`
+	Sentry    *opts.Sentry    `group:"Sentry" namespace:"sentry" env-namespace:"SENTRY"`
 }
 
 // Execute is the entry point for "api" command, called by flag parser
 func (s *APICommand) Execute(args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("[INFO] received %v, shutting down", <-sig)
+		cancel()
+		log.Printf("[WARN] received %v, exiting immediately", <-sig)
+		os.Exit(1)
+	}()
+
 	db, err := s.DB.GetPool()
 	if err != nil {
 		log.Fatalf("DB connection failed: %v", err)
 	}
 	log.Print("[INFO] connected to DB")
 
-	deadline := maxTime
-	if s.Deadline != "" {
-		d, err := time.Parse(time.RFC3339, s.Deadline)
+	var quotas []*models.Quota
+	for _, v := range s.Quotas {
+		q, err := models.ParseQuota(v)
 		if err != nil {
 			return err
 		}
-		deadline = d
-		log.Printf("[INFO] Submission deadline: %v", deadline)
+		quotas = append(quotas, q)
+	}
+
+	blobs, err := storage.New(s.Storage, s.AWS)
+	if err != nil {
+		return err
 	}
 
 	server := api.Server{
@@ -47,18 +77,41 @@ func (s *APICommand) Execute(args []string) error {
 		Env:    s.Env,
 		Sentry: s.Sentry,
 		API: api.API{
-			DB:          db,
-			OAuth:       s.Github.OAuth,
-			App:         s.Github.App,
-			AWS:         s.AWS,
-			Jwt:         s.Jwt,
-			RandomState: utils.RandomString(32),
-			WebUrl:      s.WebURL,
-			EnvType:     s.Env.Type,
-			Deadline:    deadline,
+			DB:           db,
+			OAuth:        s.Github.OAuth,
+			App:          s.Github.App,
+			Blobs:        blobs,
+			Jwt:          s.Jwt,
+			RandomState:  utils.RandomString(32),
+			WebUrl:       s.WebURL,
+			EnvType:      s.Env.Type,
+			TaskLease:    s.Lease,
+			TaskRetries:  s.Retries,
+			RerunLimit:   s.Reruns,
+			Supersede:    s.Supersede,
+			PushBranches: s.Branches,
+			PullRequests: s.Pulls,
+			PullReviews:  s.Reviews,
+			CheckRunsPer: s.CheckRuns,
+			Quotas:       quotas,
 		},
 	}
-	server.Start()
+
+	// The former global deadline is kept for the courses that have no
+	// deadlines at all.
+	if s.Deadline != "" {
+		deadline, err := time.Parse(time.RFC3339, s.Deadline)
+		if err != nil {
+			return err
+		}
+		n, err := server.API.SeedDeadlines(ctx, deadline)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Submission deadline %v is set for %d courses", deadline, n)
+	}
+
+	server.Start(ctx)
 	return nil
 }
 
@@ -3,28 +3,51 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/mkuznets/classbox/pkg/opts"
 	"github.com/mkuznets/classbox/pkg/runner"
+	"github.com/mkuznets/classbox/pkg/storage"
 )
 
 // RunnerCommand with command line flags and env
 type RunnerCommand struct {
-	Env     *opts.Env       `group:"Environment" namespace:"env" env-namespace:"ENV"`
-	ApiURL  string          `long:"api-url" env:"API_URL" description:"base API URL" required:"true"`
-	DataDir string          `long:"data-dir" env:"DATA_DIR" description:"exposed data directory" required:"true"`
-	WebURL  string          `long:"web-url" env:"WEB_URL" description:"url to website" required:"true"`
-	DocsURL string          `long:"docs-url" env:"DOCS_URL" description:"url to generated docs" required:"true"`
-	Jwt     *opts.JwtClient `group:"JWT" namespace:"jwt" env-namespace:"JWT"`
-	Sentry  *opts.Sentry    `group:"Sentry" namespace:"sentry" env-namespace:"SENTRY"`
-	Docker  *opts.Docker    `group:"Docker" namespace:"docker"  env-namespace:"DOCKER"`
-	Debug   bool            `long:"debug" description:"show debug info" required:"false"`
+	Env         *opts.Env       `group:"Environment" namespace:"env" env-namespace:"ENV"`
+	ApiURL      string          `long:"api-url" env:"API_URL" description:"base API URL" required:"true"`
+	DataDir     string          `long:"data-dir" env:"DATA_DIR" description:"exposed data directory" required:"true"`
+	WebURL      string          `long:"web-url" env:"WEB_URL" description:"url to website" required:"true"`
+	DocsURL     string          `long:"docs-url" env:"DOCS_URL" description:"url to generated docs" required:"true"`
+	Course      string          `long:"course" env:"COURSE" description:"course to run tests for" default:"stdlib"`
+	Concurrency int             `long:"concurrency" env:"CONCURRENCY" description:"number of tests to run in parallel" default:"1"`
+	GracePeriod time.Duration   `long:"grace-period" env:"GRACE_PERIOD" description:"time to complete the current task on shutdown" default:"1m"`
+	Regrade     bool            `long:"regrade-on-upgrade" env:"REGRADE_ON_UPGRADE" description:"re-run the latest graded commits when tests or baselines change"`
+	MaxOutput   int             `long:"max-output" env:"MAX_OUTPUT" description:"max size of test output in bytes, full logs are uploaded to the blob storage, 0 disables truncation" default:"65536"`
+	Jwt         *opts.JwtClient `group:"JWT" namespace:"jwt" env-namespace:"JWT"`
+	Sentry      *opts.Sentry    `group:"Sentry" namespace:"sentry" env-namespace:"SENTRY"`
+	Docker      *opts.Docker    `group:"Docker" namespace:"docker"  env-namespace:"DOCKER"`
+	Storage     *opts.Storage   `group:"Storage" namespace:"storage" env-namespace:"STORAGE"`
+	AWS         *opts.AWS       `group:"AWS" namespace:"aws" env-namespace:"AWS"`
+	Debug       bool            `long:"debug" description:"show debug info" required:"false"`
 }
 
 // Execute is the entry point for "server" command, called by flag parser
 func (s *RunnerCommand) Execute(args []string) error {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("[INFO] received %v, shutting down", <-sig)
+		cancel()
+		log.Printf("[WARN] received %v, exiting immediately", <-sig)
+		os.Exit(1)
+	}()
 
 	token, err := s.Jwt.Token()
 	if err != nil {
@@ -35,17 +58,32 @@ func (s *RunnerCommand) Execute(args []string) error {
 		return nil
 	}
 
+	// The blob storage is only used for logs of truncated outputs
+	var blobs storage.BlobStore
+	if s.MaxOutput > 0 {
+		blobs, err = storage.New(s.Storage, s.AWS)
+		if err != nil {
+			return err
+		}
+	}
+
 	cl := &runner.Runner{
-		Ctx:     ctx,
-		Env:     s.Env,
-		Sentry:  s.Sentry,
-		Http:    &http.Client{},
-		Jwt:     s.Jwt,
-		Docker:  s.Docker,
-		ApiURL:  s.ApiURL,
-		WebURL:  s.WebURL,
-		DocsURL: s.DocsURL,
-		DataDir: s.DataDir,
+		Ctx:         ctx,
+		Env:         s.Env,
+		Sentry:      s.Sentry,
+		Http:        &http.Client{},
+		Jwt:         s.Jwt,
+		Docker:      s.Docker,
+		Blobs:       blobs,
+		MaxOutput:   s.MaxOutput,
+		Course:      s.Course,
+		ApiURL:      s.ApiURL,
+		WebURL:      s.WebURL,
+		DocsURL:     s.DocsURL,
+		DataDir:     s.DataDir,
+		Concurrency: s.Concurrency,
+		GracePeriod: s.GracePeriod,
+		Regrade:     s.Regrade,
 	}
 	cl.Do()
 
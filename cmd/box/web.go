@@ -14,6 +14,7 @@ type WebCommand struct {
 	ApiURL  string       `long:"api-url" env:"API_URL" description:"base API URL" required:"true"`
 	DocsURL string       `long:"docs-url" env:"DOCS_URL" description:"url to generated docs" required:"true"`
 	WebURL  string       `long:"web-url" env:"WEB_URL" description:"url to website" required:"true"`
+	Course  string       `long:"course" env:"COURSE" description:"default course" default:"stdlib"`
 }
 
 // Execute is the entry point for "api" command, called by flag parser
@@ -33,6 +34,7 @@ func (s *WebCommand) Execute(args []string) error {
 			DocsURL:   s.DocsURL,
 			WebURL:    s.WebURL,
 			ApiURL:    s.ApiURL,
+			Course:    s.Course,
 		},
 	}
 	server.Start()
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// audit records an action of the authenticated staff member, or of the
+// runner if there is none, in the course audit log.
+func audit(ctx context.Context, tx pgx.Tx, courseID uint64, action, target string, details interface{}) error {
+	var userID *uint64
+	if user, ok := ctx.Value("User").(*models.User); ok {
+		userID = &user.Id
+	}
+	_, err := tx.Exec(ctx, `
+	INSERT INTO audit_log (course_id, user_id, action, target, details) VALUES ($1, $2, $3, $4, $5)
+	`, courseID, userID, action, target, details)
+	return errors.WithStack(err)
+}
+
+func listLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultListLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, E.New(err, http.StatusBadRequest, "invalid limit")
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	return limit, nil
+}
+
+func (api *API) GetStudents(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	rows, err := api.DB.Query(r.Context(), `
+	SELECT u.login, e.repository_name, COALESCE(ro.role::text, ''), COUNT(c.id), MAX(c.submitted_at)
+	FROM users AS u
+		JOIN enrollments AS e ON (e.user_id=u.id)
+		LEFT JOIN roles AS ro ON (ro.user_id=u.id AND ro.course_id=e.course_id)
+		LEFT JOIN commits AS c ON (c.user_id=u.id AND c.course_id=e.course_id)
+	WHERE e.course_id=$1
+	GROUP BY u.id, e.id, ro.id
+	ORDER BY u.login
+	`, course.Id)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	students := make([]*models.Student, 0)
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		s := models.Student{}
+		if err := rows.Scan(&s.Login, &s.Repo, &s.Role, &s.Commits, &s.LastCommit); err != nil {
+			return errors.WithStack(err)
+		}
+		students = append(students, &s)
+		return nil
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, &students)
+}
+
+// GetCommits lists the latest commits of the course, optionally of a single
+// user (?login=...).
+func (api *API) GetCommits(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	limit, err := listLimit(r)
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	rows, err := api.DB.Query(r.Context(), `
+	SELECT u.login, e.repository_name, c.commit, UPPER(t.status::text), t.id::text, c.submitted_at
+	FROM commits AS c
+		JOIN users AS u ON (u.id=c.user_id)
+		JOIN enrollments AS e ON (e.user_id=u.id AND e.course_id=c.course_id)
+		JOIN tasks AS t ON (t.commit_id=c.id)
+	WHERE c.course_id=$1 AND ($2='' OR u.login=$2)
+	ORDER BY c.id DESC
+	LIMIT $3
+	`, course.Id, r.URL.Query().Get("login"), limit)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	commits := make([]*models.Commit, 0)
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		c := models.Commit{}
+		if err := rows.Scan(&c.Login, &c.Repo, &c.Commit, &c.Status, &c.TaskID, &c.Submitted); err != nil {
+			return errors.WithStack(err)
+		}
+		commits = append(commits, &c)
+		return nil
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, &commits)
+}
+
+// GetStudentChecks returns the latest check of each test for the user,
+// including ones that have not been graded.
+func (api *API) GetStudentChecks(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+	login := chi.URLParam(r, "login")
+
+	rows, err := api.DB.Query(r.Context(), `
+	SELECT DISTINCT ON (ch.test_id) t.name, ch.name, UPPER(ch.status::text), ch.output, ch.results, ch.credit, ch.is_cached
+	FROM checks AS ch
+		JOIN commits AS c ON (c.id=ch.commit_id)
+		JOIN users AS u ON (u.id=c.user_id)
+		JOIN tests AS t ON (t.id=ch.test_id)
+	WHERE c.course_id=$1 AND u.login=$2 AND t.is_deleted='f'
+	ORDER BY ch.test_id, ch.id DESC
+	`, course.Id, login)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	checks := make([]*models.Stage, 0)
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		s := models.Stage{}
+		if err := rows.Scan(&s.Test, &s.Name, &s.Status, &s.Output, &s.Results, &s.Credit, &s.Cached); err != nil {
+			return errors.WithStack(err)
+		}
+		checks = append(checks, &s)
+		return nil
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, &checks)
+}
+
+// ResetTask hands a stuck task back to the queue and resets its retry counter.
+// Finished and skipped tasks have to be re-run instead.
+func (api *API) ResetTask(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	taskID := chi.URLParam(r, "taskID")
+	if _, err := uuid.Parse(taskID); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+
+	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+		ct, err := tx.Exec(r.Context(), `
+		UPDATE tasks
+		SET status='enqueued', started_at=NULL, runner_id=NULL, lease_expires_at=NULL, retries=0
+		WHERE id=$1 AND status IN ('enqueued', 'executing')
+			AND commit_id IN (SELECT id FROM commits WHERE course_id=$2)
+		`, taskID, course.Id)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ct.RowsAffected() == 0 {
+			e := fmt.Errorf("unknown or finished task: %s", taskID)
+			return E.New(e, http.StatusConflict, e.Error())
+		}
+		return audit(r.Context(), tx, course.Id, "reset_task", taskID, nil)
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// UpdateTest hides a test from students or brings it back. The flag is
+// overwritten by the next update of the course tests.
+func (api *API) UpdateTest(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+	name := chi.URLParam(r, "test")
+
+	var req struct {
+		Deleted bool `json:"is_deleted"`
+	}
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+
+	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+		ct, err := tx.Exec(r.Context(), `
+		UPDATE tests SET is_deleted=$3 WHERE course_id=$1 AND name=$2
+		`, course.Id, name, req.Deleted)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ct.RowsAffected() == 0 {
+			e := fmt.Errorf("unknown test: %s", name)
+			return E.New(e, http.StatusNotFound, e.Error())
+		}
+		return audit(r.Context(), tx, course.Id, "update_test", name, &req)
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// UpdateRole assigns a course role to a user, an empty role revokes it
+func (api *API) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	var req models.User
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+	switch req.Role {
+	case "", models.RoleInstructor, models.RoleAssistant:
+	default:
+		e := fmt.Errorf("unknown role: %s", req.Role)
+		E.SendError(w, r, e, http.StatusBadRequest, e.Error())
+		return
+	}
+
+	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+		var userID uint64
+		err := tx.QueryRow(r.Context(), `SELECT id FROM users WHERE login=$1 LIMIT 1`, req.Login).Scan(&userID)
+		switch {
+		case err == pgx.ErrNoRows:
+			e := fmt.Errorf("unknown user: %s", req.Login)
+			return E.New(e, http.StatusNotFound, e.Error())
+		case err != nil:
+			return errors.WithStack(err)
+		}
+
+		if req.Role == "" {
+			_, err = tx.Exec(r.Context(), `
+			DELETE FROM roles WHERE user_id=$1 AND course_id=$2
+			`, userID, course.Id)
+		} else {
+			_, err = tx.Exec(r.Context(), `
+			INSERT INTO roles (user_id, course_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, course_id) DO UPDATE SET role=EXCLUDED.role
+			`, userID, course.Id, req.Role)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return audit(r.Context(), tx, course.Id, "update_role", req.Login, map[string]string{"role": req.Role})
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+func (api *API) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	limit, err := listLimit(r)
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	rows, err := api.DB.Query(r.Context(), `
+	SELECT COALESCE(u.login, ''), a.action, a.target, a.details, a.created_at
+	FROM audit_log AS a LEFT JOIN users AS u ON (u.id=a.user_id)
+	WHERE a.course_id=$1
+	ORDER BY a.id DESC
+	LIMIT $2
+	`, course.Id, limit)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	entries := make([]*models.AuditEntry, 0)
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		a := models.AuditEntry{}
+		if err := rows.Scan(&a.Login, &a.Action, &a.Target, &a.Details, &a.Time); err != nil {
+			return errors.WithStack(err)
+		}
+		entries = append(entries, &a)
+		return nil
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, &entries)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/github"
+	"github.com/pkg/errors"
+)
+
+// maxAnnotations limits annotations of a single check run, outputs of broken
+// builds may contain many more locations than anyone would read
+const maxAnnotations = 250
+
+// locationRe matches locations reported by the compiler and by failing tests,
+// e.g. "./main.go:12:5: undefined: x" or "    main_test.go:25: got 1".
+// Absolute paths are not matched as they point outside of the repository.
+var locationRe = regexp.MustCompile(`^\s*(?:\./)?((?:[\w.-]+/)*[\w.-]+\.go):(\d+)(?::(\d+))?: (.+)$`)
+
+// annotations finds locations in outputs of the failed stages. Only files of
+// the submitted tree are annotated: e.g. failing tests report bare names of
+// test files that belong to the course.
+func annotations(stages []*models.Stage, files map[string]bool) []*github.Annotation {
+	var (
+		result []*github.Annotation
+		seen   = map[string]bool{}
+	)
+
+	add := func(title, output string) {
+		for _, line := range strings.Split(output, "\n") {
+			m := locationRe.FindStringSubmatch(strings.TrimRight(line, "\r"))
+			if m == nil || !files[m[1]] || len(result) >= maxAnnotations {
+				continue
+			}
+			key := fmt.Sprintf("%s:%s:%s", m[1], m[2], m[4])
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			a := &github.Annotation{Path: m[1], Level: "failure", Title: title, Message: m[4]}
+			a.StartLine, _ = strconv.Atoi(m[2])
+			a.EndLine = a.StartLine
+			if m[3] != "" {
+				a.StartColumn, _ = strconv.Atoi(m[3])
+				a.EndColumn = a.StartColumn
+			}
+			result = append(result, a)
+		}
+	}
+
+	for _, s := range stages {
+		if s.Status == "success" {
+			continue
+		}
+		add(s.Name, s.Output)
+		for _, r := range s.Results {
+			if r.Status == "fail" {
+				add(fmt.Sprintf("%s: %s", s.Name, r.Name), r.Output)
+			}
+		}
+	}
+	return result
+}
+
+// commitFiles returns the set of files in the tree of the commit
+func commitFiles(ctx context.Context, gh *github.Client, login, repo, commitHash string) (map[string]bool, error) {
+	paths, err := gh.Files(ctx, login, repo, commitHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list files of the commit")
+	}
+	files := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		files[p] = true
+	}
+	return files, nil
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/github"
+)
+
+func TestAnnotations(t *testing.T) {
+	stages := []*models.Stage{
+		{
+			Name:   "build::sort",
+			Status: "failure",
+			Output: "# sort\n./sort/sort.go:12:5: undefined: x\nsort/sort.go:12:5: undefined: x\n/usr/local/go/src/sort.go:3: outside\n",
+		},
+		{
+			Name:   "test::heap",
+			Status: "failure",
+			Output: "    heap_test.go:42: expected 3, got 4\n",
+			Results: []*models.TestResult{
+				{Name: "TestHeap/large", Status: "fail", Output: "    heap/heap.go:7: called from here\r\n"},
+				{Name: "TestHeap/empty", Status: "pass", Output: "    heap/heap.go:9: passed\n"},
+			},
+		},
+		{
+			Name:   "test::list",
+			Status: "success",
+			Output: "    list/list.go:1: fine\n",
+		},
+	}
+	files := map[string]bool{"sort/sort.go": true, "heap/heap.go": true, "list/list.go": true}
+
+	expected := []*github.Annotation{
+		{Path: "sort/sort.go", StartLine: 12, EndLine: 12, StartColumn: 5, EndColumn: 5, Level: "failure", Title: "build::sort", Message: "undefined: x"},
+		{Path: "heap/heap.go", StartLine: 7, EndLine: 7, Level: "failure", Title: "test::heap: TestHeap/large", Message: "called from here"},
+	}
+	got := annotations(stages, files)
+	if !reflect.DeepEqual(got, expected) {
+		for _, a := range got {
+			t.Logf("%+v", a)
+		}
+		t.Fatalf("unexpected annotations")
+	}
+
+	if got := annotations(stages, nil); len(got) != 0 {
+		t.Fatalf("expected no annotations without files, got %d", len(got))
+	}
+}
@@ -1,15 +1,19 @@
 package api
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/mkuznets/classbox/pkg/opts"
+	"github.com/mkuznets/classbox/pkg/storage"
 )
 
 // API is a collection of endpoints
@@ -17,14 +21,34 @@ type API struct {
 	DB          *pgxpool.Pool
 	OAuth       *opts.OAuth
 	App         *opts.App
-	AWS         *opts.AWS
+	Blobs       storage.BlobStore
 	Jwt         *opts.JwtServer
 	RandomState string
 	WebUrl      string
 	EnvType     string
-	Deadline    time.Time
+	TaskLease   time.Duration
+	TaskRetries int
+	RerunLimit  int
+	Supersede   bool
+	// PushBranches are branches whose pushes are graded, if set,
+	// automatic check suites are ignored
+	PushBranches []string
+	PullRequests bool // grade pull requests into enrolled repositories
+	PullReviews  bool // review pull requests with failed tests
+	// CheckRunsPer is "test" or "topic" to report results in a separate
+	// check run per test or topic in addition to the one of the commit
+	CheckRunsPer string
+	Quotas       []*models.Quota
+	// background tracks goroutines that outlive their requests, they are
+	// awaited on shutdown
+	background sync.WaitGroup
+	tasks      *notifier
+	progress   *notifier
 }
 
+// shutdownTimeout limits the time to finish requests in progress on shutdown
+const shutdownTimeout = 30 * time.Second
+
 // Server is a
 type Server struct {
 	Addr   string
@@ -34,10 +58,14 @@ type Server struct {
 	API    API
 }
 
-// Start initialises the server
-func (s *Server) Start() {
+// Start initialises the server and serves requests until the context is
+// cancelled
+func (s *Server) Start(ctx context.Context) {
 	log.Printf("[INFO] environment: %s", s.Env.Type)
 
+	s.API.tasks = newNotifier()
+	s.API.progress = newNotifier()
+
 	router := chi.NewRouter()
 	router.Use(middleware.Timeout(30 * time.Second))
 	router.Use(middleware.Recoverer)
@@ -52,49 +80,96 @@ func (s *Server) Start() {
 
 	router.Route("/", func(r chi.Router) {
 
-		// web endpoints
-		r.Get("/stats", s.API.GetStats)
-		r.Get("/solutions", s.API.GetSolutions)
-		r.Route("/auth", func(r chi.Router) {
-			r.Get("/app", s.API.AppURL)
-			r.Get("/oauth", s.API.OAuthURL)
-			r.Post("/signin", s.API.Signin)
-			r.Post("/create", s.API.CreateUser)
-			r.Post("/install", s.API.InstallApp)
-		})
-		r.Get("/commits/{login}:{commitHash:[0-9a-z]+}", s.API.GetCommit)
-		r.Get("/tests", s.API.GetTests)
-		r.With(userAuth(s.API.DB)).Group(func(r chi.Router) {
-			r.Get("/user", s.API.GetUser)
-			r.Get("/user/stats", s.API.GetUserStats)
-		})
-
-		r.Route("/course", func(r chi.Router) {
-			r.With(jwtValidator(s.API.Jwt.Key)).Get("/", s.API.GetCourse)
-			r.Put("/", s.API.UpdateCourse)
-		})
+		r.Get("/courses", s.API.GetCourses)
+		r.Get("/blobs/*", s.API.GetBlob)
 
 		// webhook endpoint
-		r.With(hookValidator(s.API.App.HookSecret)).
+		r.With(hookValidator(s.API.DB, s.API.App.HookSecrets, s.API.App.HookSHA1)).
 			With(middleware.Logger).
 			Post("/tasks/enqueue", s.API.EnqueueTask)
 
-		// private runner's endpoints
-		r.With(jwtValidator(s.API.Jwt.Key)).Group(func(r chi.Router) {
-			r.Put("/tests", s.API.UpdateTests)
-			r.Route("/runs", func(r chi.Router) {
-				r.Get("/", s.API.GetRuns)
-				r.Put("/", s.API.CreateRuns)
-				r.Get("/baselines", s.API.GetBaselines)
+		r.With(courseCtx(s.API.DB)).Route("/courses/{course:[0-9a-z-]+}", func(r chi.Router) {
+
+			// web endpoints
+			r.Get("/stats", s.API.GetStats)
+			r.Get("/solutions", s.API.GetSolutions)
+			r.Route("/auth", func(r chi.Router) {
+				r.Get("/app", s.API.AppURL)
+				r.Get("/oauth", s.API.OAuthURL)
+				r.Post("/signin", s.API.Signin)
+				r.Post("/create", s.API.CreateUser)
+				r.Post("/install", s.API.InstallApp)
 			})
-			r.Route("/tasks", func(r chi.Router) {
-				r.Post("/{taskID:[0-9a-z-]+}", s.API.FinishTask)
-				r.Post("/dequeue", s.API.DequeueTask)
+			r.Get("/commits/{login}:{commitHash:[0-9a-z]+}", s.API.GetCommit)
+			r.Get("/commits/{login}:{commitHash:[0-9a-z]+}/progress", s.API.GetProgress)
+			r.Get("/tests", s.API.GetTests)
+			r.Get("/deadlines", s.API.GetDeadlines)
+			r.With(userAuth(s.API.DB)).Group(func(r chi.Router) {
+				r.Get("/user", s.API.GetUser)
+				r.Get("/user/stats", s.API.GetUserStats)
+				r.Get("/queue", s.API.GetQueue)
+				r.Post("/commits/{login}:{commitHash:[0-9a-z]+}/rerun", s.API.RerunCommit)
+			})
+
+			// course staff endpoints
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(staffAuth(s.API.DB, models.RoleInstructor, models.RoleAssistant))
+				r.Get("/users", s.API.GetStudents)
+				r.Get("/users/{login}/checks", s.API.GetStudentChecks)
+				r.Get("/commits", s.API.GetCommits)
+				r.Post("/commits/{login}:{commitHash:[0-9a-z]+}/enqueue", s.API.EnqueueCommit)
+				r.Post("/rerun", s.API.RerunExceptions)
+				r.Post("/tasks/{taskID:[0-9a-z-]+}/reset", s.API.ResetTask)
+				r.Get("/webhooks", s.API.GetWebhooks)
+				r.Post("/webhooks/{deliveryID:[0-9a-z-]+}/replay", s.API.ReplayWebhook)
+				r.Put("/tests/{test}", s.API.UpdateTest)
+				r.Put("/extensions", s.API.GrantExtension)
+				r.Get("/audit", s.API.GetAuditLog)
+				r.With(staffAuth(s.API.DB, models.RoleInstructor)).Put("/roles", s.API.UpdateRole)
+			})
+
+			// private runner's endpoints
+			r.With(jwtValidator(s.API.Jwt.Key)).Group(func(r chi.Router) {
+				r.Get("/", s.API.GetCourse)
+				r.Put("/", s.API.UpdateCourse)
+				r.Put("/tests", s.API.UpdateTests)
+				r.Put("/deadlines", s.API.UpdateDeadlines)
+				r.Put("/extensions", s.API.GrantExtension)
+				r.Put("/roles", s.API.UpdateRole)
+				r.Route("/runs", func(r chi.Router) {
+					r.Get("/", s.API.GetRuns)
+					r.Put("/", s.API.CreateRuns)
+					r.Get("/baselines", s.API.GetBaselines)
+				})
+				r.Put("/runners/{runnerID:[0-9a-z-]+}", s.API.RegisterRunner)
+				r.Route("/tasks", func(r chi.Router) {
+					r.Post("/{taskID:[0-9a-z-]+}", s.API.FinishTask)
+					r.Post("/{taskID:[0-9a-z-]+}/stages", s.API.ReportStages)
+					r.Post("/{taskID:[0-9a-z-]+}/release", s.API.ReleaseTask)
+					r.Post("/dequeue", s.API.DequeueTask)
+				})
 			})
 		})
 	})
 
-	if err := http.ListenAndServe(s.Addr, router); err != nil {
+	go s.API.ReapTasks(ctx)
+	go s.API.ListenTasks(ctx)
+	go s.API.PruneWebhooks(ctx)
+
+	srv := &http.Server{Addr: s.Addr, Handler: router}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Printf("[WARN] could not shut down the server: %v", err)
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Printf("[WARN] server has terminated: %s", err)
 	}
+
+	log.Print("[INFO] waiting for background requests to Github")
+	s.API.background.Wait()
 }
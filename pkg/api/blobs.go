@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/go-chi/chi"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/storage"
+	"github.com/pkg/errors"
+)
+
+// GetBlob serves blobs of the local storage by signed URLs. With other
+// storages blobs are downloaded from them directly.
+func (api *API) GetBlob(w http.ResponseWriter, r *http.Request) {
+	local, ok := api.Blobs.(*storage.Local)
+	if !ok {
+		E.SendError(w, r, nil, http.StatusNotFound, "not found")
+		return
+	}
+
+	key := chi.URLParam(r, "*")
+	f, err := local.Open(key, r.URL.Query().Get("expires"), r.URL.Query().Get("signature"))
+	switch {
+	case err == storage.ErrInvalidURL:
+		E.SendError(w, r, err, http.StatusForbidden, err.Error())
+		return
+	case os.IsNotExist(errors.Cause(err)):
+		E.SendError(w, r, nil, http.StatusNotFound, "not found")
+		return
+	case err != nil:
+		E.Handle(w, r, err)
+		return
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+	http.ServeContent(w, r, path.Base(key), stat.ModTime(), f)
+}
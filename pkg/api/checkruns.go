@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/mkuznets/classbox/pkg/github"
+	"github.com/pkg/errors"
+)
+
+// Ways to report results in Github check runs
+const (
+	checkRunsPerCommit = "commit" // a single check run of the commit
+	checkRunsPerTest   = "test"
+	checkRunsPerTopic  = "topic"
+)
+
+// testCheckRunsTimeout limits the time to create check runs of all tests of
+// a commit, including waits for the rate limit
+const testCheckRunsTimeout = 5 * time.Minute
+
+// checkRunConclusion returns the conclusion and the title of a check run
+// with the given stages. Stages that are not graded as they are late do not
+// fail the check run, which is neutral if none of the stages is graded.
+func checkRunConclusion(stages []*models.Stage, late *lateness) (string, string) {
+	failures := make([]string, 0)
+	graded := 0
+	for _, s := range stages {
+		if !late.graded(s.Test) {
+			continue
+		}
+		graded++
+		if s.Status != "success" {
+			failures = append(failures, s.Name)
+		}
+	}
+	switch {
+	case len(failures) > 0:
+		return "failure", fmt.Sprintf("Failed: %s", strings.Join(failures, " , "))
+	case graded == 0 && len(stages) > 0:
+		return "neutral", "Not graded: the deadline has passed"
+	}
+	return "success", "Success"
+}
+
+// createTestCheckRuns reports the stages of each test or topic in a separate
+// completed check run. Stages that do not belong to a test, e.g. system
+// errors, are only reported in the check run of the commit. Conclusions follow
+// the one of the commit, late stages are not graded. Locations in the given
+// files are annotated.
+func (api *API) createTestCheckRuns(ctx context.Context, gh *github.Client, course *models.Course, login, repo, commitHash string, stages []*models.Stage, late *lateness, files map[string]bool) error {
+	topics := make(map[string]string)
+	if api.CheckRunsPer == checkRunsPerTopic {
+		rows, err := api.DB.Query(ctx, `SELECT name, topic FROM tests WHERE course_id=$1`, course.Id)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = db.IterRows(rows, func(rows pgx.Rows) error {
+			var name, topic string
+			if err := rows.Scan(&name, &topic); err != nil {
+				return errors.WithStack(err)
+			}
+			topics[name] = topic
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		keys   []string
+		groups = make(map[string][]*models.Stage)
+	)
+	for _, s := range stages {
+		test := s.Test
+		if test == "" && strings.HasPrefix(s.Name, "build::") {
+			test = strings.TrimPrefix(s.Name, "build::")
+		}
+		key := test
+		if api.CheckRunsPer == checkRunsPerTopic {
+			key = topics[test]
+		}
+		if key == "" {
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], s)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	checkRuns := make([]*github.CheckRun, 0, len(keys))
+	for _, key := range keys {
+		summary, err := api.checkRunSummary(course.Name, login, commitHash, groups[key])
+		if err != nil {
+			return err
+		}
+		conclusion, title := checkRunConclusion(groups[key], late)
+		checkRuns = append(checkRuns, &github.CheckRun{
+			Name:           fmt.Sprintf("%s: %s", course.Name, key),
+			Commit:         commitHash,
+			Url:            api.commitURL(course.Name, login, commitHash),
+			Status:         "completed",
+			Conclusion:     conclusion,
+			CompletionTime: now,
+			Output: &github.CheckRunOutput{
+				Title:       title,
+				Summary:     summary,
+				Annotations: annotations(groups[key], files),
+			},
+		})
+	}
+
+	_, err := gh.CreateCheckRuns(ctx, login, repo, checkRuns)
+	return err
+}
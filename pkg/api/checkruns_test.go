@@ -0,0 +1,40 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+func TestCheckRunConclusion(t *testing.T) {
+	late := &lateness{tests: map[string]*models.Deadline{
+		"late":       {Test: "late", LatePolicy: models.LatePolicyReject},
+		"discounted": {Test: "discounted", LatePolicy: models.LatePolicyMultiplier, Multiplier: multiplier(0.5)},
+	}}
+	stage := func(test, status string) *models.Stage {
+		return &models.Stage{Name: "test::" + test, Test: test, Status: status}
+	}
+
+	cases := []struct {
+		name       string
+		stages     []*models.Stage
+		late       *lateness
+		conclusion string
+	}{
+		{"success", []*models.Stage{stage("a", "success")}, nil, "success"},
+		{"failure", []*models.Stage{stage("a", "success"), stage("b", "failure")}, nil, "failure"},
+		{"late failure", []*models.Stage{stage("a", "success"), stage("late", "failure")}, late, "success"},
+		{"only late", []*models.Stage{stage("late", "success")}, late, "neutral"},
+		{"discounted failure", []*models.Stage{stage("discounted", "failure")}, late, "failure"},
+		{"system error", []*models.Stage{{Name: "system", Status: "exception"}, stage("late", "success")}, late, "failure"},
+	}
+	for _, c := range cases {
+		if conclusion, _ := checkRunConclusion(c.stages, c.late); conclusion != c.conclusion {
+			t.Errorf("%s: expected %s, got %s", c.name, c.conclusion, conclusion)
+		}
+	}
+}
+
+func multiplier(v float64) *float64 {
+	return &v
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/pkg/errors"
@@ -15,6 +16,8 @@ import (
 
 type Client struct {
 	baseUrl string
+	course  string
+	runner  string
 	http    *http.Client
 	token   *oauth2.Token
 	session string
@@ -59,6 +62,9 @@ func (c *Client) createRequest(ctx context.Context, method string, path string,
 	if c.session != "" {
 		req.Header.Set("X-Session", c.session)
 	}
+	if c.runner != "" {
+		req.Header.Set("X-Runner-ID", c.runner)
+	}
 	return req, nil
 }
 
@@ -98,9 +104,39 @@ func (c *Client) Auth(token *oauth2.Token) {
 	c.token = token
 }
 
-func (c *Client) DequeueTask(ctx context.Context) (*models.Task, error) {
+// SetCourse sets the course that course-scoped requests refer to
+func (c *Client) SetCourse(course string) {
+	c.course = course
+}
+
+// SetRunner sets the runner ID sent along with task requests
+func (c *Client) SetRunner(id string) {
+	c.runner = id
+}
+
+func (c *Client) coursePath(path string) string {
+	return fmt.Sprintf("/courses/%s%s", c.course, path)
+}
+
+func (c *Client) RegisterRunner(ctx context.Context, hostname string) (*models.Runner, error) {
+	path := c.coursePath(fmt.Sprintf("/runners/%s", c.runner))
+	data, err := json.Marshal(&models.Runner{Hostname: hostname})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var runner models.Runner
+	if err := c.request(ctx, "PUT", path, data, &runner); err != nil {
+		return nil, err
+	}
+	return &runner, nil
+}
+
+// DequeueTask requests a new task. If there are no enqueued tasks, the API
+// waits up to the given time for a new one.
+func (c *Client) DequeueTask(ctx context.Context, wait time.Duration) (*models.Task, error) {
+	path := c.coursePath(fmt.Sprintf("/tasks/dequeue?wait=%d", int(wait.Seconds())))
 	task := models.Task{}
-	if err := c.request(ctx, "POST", "/tasks/dequeue", nil, &task); err != nil {
+	if err := c.request(ctx, "POST", path, nil, &task); err != nil {
 		return nil, err
 	}
 	if task.Id == "" {
@@ -110,7 +146,7 @@ func (c *Client) DequeueTask(ctx context.Context) (*models.Task, error) {
 }
 
 func (c *Client) FinishTask(ctx context.Context, taskId string, stages []*models.Stage) error {
-	path := fmt.Sprintf("/tasks/%s", taskId)
+	path := c.coursePath(fmt.Sprintf("/tasks/%s", taskId))
 	data, err := json.Marshal(stages)
 	if err != nil {
 		return errors.WithStack(err)
@@ -121,12 +157,34 @@ func (c *Client) FinishTask(ctx context.Context, taskId string, stages []*models
 	return nil
 }
 
+// ReportStages sends stages of the task completed so far
+func (c *Client) ReportStages(ctx context.Context, taskId string, stages []*models.Stage) error {
+	path := c.coursePath(fmt.Sprintf("/tasks/%s/stages", taskId))
+	data, err := json.Marshal(stages)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := c.request(ctx, "POST", path, data, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReleaseTask hands the task back to the queue
+func (c *Client) ReleaseTask(ctx context.Context, taskId string) error {
+	path := c.coursePath(fmt.Sprintf("/tasks/%s/release", taskId))
+	if err := c.request(ctx, "POST", path, nil, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (c *Client) GetRuns(ctx context.Context, hashes []string) (map[string]*models.Run, error) {
 	vs := url.Values{}
 	for _, h := range hashes {
 		vs.Add("hash", h)
 	}
-	path := fmt.Sprintf("/runs?%s", vs.Encode())
+	path := c.coursePath(fmt.Sprintf("/runs?%s", vs.Encode()))
 
 	var runs []*models.Run
 	if err := c.request(ctx, "GET", path, nil, &runs); err != nil {
@@ -141,7 +199,7 @@ func (c *Client) GetRuns(ctx context.Context, hashes []string) (map[string]*mode
 }
 
 func (c *Client) GetCommit(ctx context.Context, login, commit string) (*models.Commit, error) {
-	path := fmt.Sprintf("/commits/%s:%s", login, commit)
+	path := c.coursePath(fmt.Sprintf("/commits/%s:%s", login, commit))
 	var resp models.Commit
 	if err := c.request(ctx, "GET", path, nil, &resp); err != nil {
 		return nil, err
@@ -149,9 +207,45 @@ func (c *Client) GetCommit(ctx context.Context, login, commit string) (*models.C
 	return &resp, nil
 }
 
+// GetProgress returns stages of the commit check reported after the given
+// number of stages. If there are none, the API waits up to the given time for
+// new stages or for the check to finish.
+func (c *Client) GetProgress(ctx context.Context, login, commit string, after int, wait time.Duration) (*models.Progress, error) {
+	path := c.coursePath(fmt.Sprintf("/commits/%s:%s/progress?after=%d&wait=%d", login, commit, after, int(wait.Seconds())))
+	var resp models.Progress
+	if err := c.request(ctx, "GET", path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RerunCommit enqueues the commit to be checked again
+func (c *Client) RerunCommit(ctx context.Context, login, commit string) error {
+	path := c.coursePath(fmt.Sprintf("/commits/%s:%s/rerun", login, commit))
+	if err := c.request(ctx, "POST", path, nil, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetQueue returns the state of the queue and the position of the commit in
+// it. If the commit is empty, the position of the current user is returned.
+func (c *Client) GetQueue(ctx context.Context, login, commit string) (*models.Queue, error) {
+	vs := url.Values{}
+	if login != "" {
+		vs.Set("login", login)
+		vs.Set("commit", commit)
+	}
+	var resp models.Queue
+	if err := c.request(ctx, "GET", c.coursePath("/queue?"+vs.Encode()), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 func (c *Client) GetTests(ctx context.Context) ([]*models.Test, error) {
 	var resp []*models.Test
-	if err := c.request(ctx, "GET", "/tests", nil, &resp); err != nil {
+	if err := c.request(ctx, "GET", c.coursePath("/tests"), nil, &resp); err != nil {
 		return nil, err
 	}
 	return resp, nil
@@ -161,7 +255,7 @@ func (c *Client) GetOauthUrl(ctx context.Context) (string, error) {
 	var resp struct {
 		Url string `json:"url"`
 	}
-	if err := c.request(ctx, "GET", "/auth/oauth", nil, &resp); err != nil {
+	if err := c.request(ctx, "GET", c.coursePath("/auth/oauth"), nil, &resp); err != nil {
 		return "", err
 	}
 	return resp.Url, nil
@@ -171,7 +265,7 @@ func (c *Client) GetAppUrl(ctx context.Context) (string, error) {
 	var resp struct {
 		Url string `json:"url"`
 	}
-	if err := c.request(ctx, "GET", "/auth/app", nil, &resp); err != nil {
+	if err := c.request(ctx, "GET", c.coursePath("/auth/app"), nil, &resp); err != nil {
 		return "", err
 	}
 	return resp.Url, nil
@@ -179,7 +273,7 @@ func (c *Client) GetAppUrl(ctx context.Context) (string, error) {
 
 func (c *Client) GetStats(ctx context.Context) ([]*models.Stat, error) {
 	var resp []*models.Stat
-	if err := c.request(ctx, "GET", "/stats", nil, &resp); err != nil {
+	if err := c.request(ctx, "GET", c.coursePath("/stats"), nil, &resp); err != nil {
 		return nil, err
 	}
 	return resp, nil
@@ -190,7 +284,7 @@ func (c *Client) GetBaselines(ctx context.Context, tests []string) (map[string]*
 	for _, h := range tests {
 		vs.Add("test", h)
 	}
-	path := fmt.Sprintf("/runs/baselines?%s", vs.Encode())
+	path := c.coursePath(fmt.Sprintf("/runs/baselines?%s", vs.Encode()))
 
 	var runs []*models.Run
 	if err := c.request(ctx, "GET", path, nil, &runs); err != nil {
@@ -209,7 +303,7 @@ func (c *Client) SubmitRuns(ctx context.Context, runs []*models.Run) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if err := c.request(ctx, "PUT", "/runs", data, nil); err != nil {
+	if err := c.request(ctx, "PUT", c.coursePath("/runs"), data, nil); err != nil {
 		return err
 	}
 	return nil
@@ -220,15 +314,23 @@ func (c *Client) UpdateTests(ctx context.Context, tests []*models.Test) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if err := c.request(ctx, "PUT", "/tests", data, nil); err != nil {
+	if err := c.request(ctx, "PUT", c.coursePath("/tests"), data, nil); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (c *Client) GetCourses(ctx context.Context) ([]*models.Course, error) {
+	var resp []*models.Course
+	if err := c.request(ctx, "GET", "/courses", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
 func (c *Client) GetCourse(ctx context.Context) (*models.Course, error) {
 	var course models.Course
-	if err := c.request(ctx, "GET", "/course", nil, &course); err != nil {
+	if err := c.request(ctx, "GET", c.coursePath("/"), nil, &course); err != nil {
 		return nil, err
 	}
 	return &course, nil
@@ -236,7 +338,7 @@ func (c *Client) GetCourse(ctx context.Context) (*models.Course, error) {
 
 func (c *Client) GetUser(ctx context.Context) (*models.User, error) {
 	var user models.User
-	if err := c.request(ctx, "GET", "/user", nil, &user); err != nil {
+	if err := c.request(ctx, "GET", c.coursePath("/user"), nil, &user); err != nil {
 		if e, ok := err.(*ErrorResponse); ok && e.Code == http.StatusUnauthorized {
 			return nil, nil
 		}
@@ -247,18 +349,18 @@ func (c *Client) GetUser(ctx context.Context) (*models.User, error) {
 
 func (c *Client) GetUserStats(ctx context.Context) (*models.UserStats, error) {
 	var stats models.UserStats
-	if err := c.request(ctx, "GET", "/user/stats", nil, &stats); err != nil {
+	if err := c.request(ctx, "GET", c.coursePath("/user/stats"), nil, &stats); err != nil {
 		return nil, err
 	}
 	return &stats, nil
 }
 
-func (c *Client) UpdateCourse(ctx context.Context, ready bool) error {
-	data, err := json.Marshal(map[string]bool{"is_ready": ready})
+func (c *Client) UpdateCourse(ctx context.Context, ready, regrade bool) error {
+	data, err := json.Marshal(&models.Course{Ready: ready, Regrade: regrade})
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if err := c.request(ctx, "PUT", "/course", data, nil); err != nil {
+	if err := c.request(ctx, "PUT", c.coursePath("/"), data, nil); err != nil {
 		return err
 	}
 	return nil
@@ -270,7 +372,7 @@ func (c *Client) Signin(ctx context.Context, code, state string) (*models.AuthSt
 		return nil, errors.WithStack(err)
 	}
 	var resp models.AuthStage
-	if err := c.request(ctx, "POST", "/auth/signin", data, &resp); err != nil {
+	if err := c.request(ctx, "POST", c.coursePath("/auth/signin"), data, &resp); err != nil {
 		return nil, errors.WithStack(err)
 	}
 	return &resp, nil
@@ -282,7 +384,7 @@ func (c *Client) CreateUser(ctx context.Context, code, state string) (*models.Au
 		return nil, errors.WithStack(err)
 	}
 	var resp models.AuthStage
-	if err := c.request(ctx, "POST", "/auth/create", data, &resp); err != nil {
+	if err := c.request(ctx, "POST", c.coursePath("/auth/create"), data, &resp); err != nil {
 		return nil, errors.WithStack(err)
 	}
 	return &resp, nil
@@ -294,7 +396,7 @@ func (c *Client) InstallApp(ctx context.Context, instId uint64, state string) (*
 		return nil, errors.WithStack(err)
 	}
 	var resp models.AuthStage
-	if err := c.request(ctx, "POST", "/auth/install", body, &resp); err != nil {
+	if err := c.request(ctx, "POST", c.coursePath("/auth/install"), body, &resp); err != nil {
 		return nil, errors.WithStack(err)
 	}
 	return &resp, nil
@@ -14,6 +14,7 @@ import (
 )
 
 func (api *API) GetCommit(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	commitHash := chi.URLParam(r, "commitHash")
 	login := chi.URLParam(r, "login")
@@ -24,11 +25,14 @@ func (api *API) GetCommit(w http.ResponseWriter, r *http.Request) {
 	)
 
 	err := api.DB.QueryRow(r.Context(), `
-	SELECT c.id, c.commit, u.login, u.repository_name, UPPER(t.status::text)
-	FROM commits AS c JOIN users AS u ON(c.user_id=u.id) JOIN tasks AS t ON(c.id=t.commit_id)
-	WHERE c.commit=$1 AND u.login=$2
+	SELECT c.id, c.commit, u.login, e.repository_name, UPPER(t.status::text)
+	FROM commits AS c
+		JOIN users AS u ON(c.user_id=u.id)
+		JOIN enrollments AS e ON(e.user_id=u.id AND e.course_id=c.course_id)
+		JOIN tasks AS t ON(c.id=t.commit_id)
+	WHERE c.commit=$1 AND u.login=$2 AND c.course_id=$3
 	LIMIT 1
-	`, commitHash, login).Scan(&commitID, &resp.Commit, &resp.Login, &resp.Repo, &resp.Status)
+	`, commitHash, login, course.Id).Scan(&commitID, &resp.Commit, &resp.Login, &resp.Repo, &resp.Status)
 
 	switch {
 	case err == pgx.ErrNoRows:
@@ -40,9 +44,20 @@ func (api *API) GetCommit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := api.DB.Query(r.Context(), `
-	SELECT name, UPPER(status::text), output FROM checks WHERE commit_id=$1 ORDER BY test_id NULLS FIRST, id
-	`, commitID)
+	// Until the task is finished, the stages reported by the runner so far
+	// are shown instead of the checks.
+	query := `
+	SELECT name, UPPER(status::text), output, results, COALESCE(log_key, '')
+	FROM checks WHERE commit_id=$1 ORDER BY test_id NULLS FIRST, id
+	`
+	if resp.Status == "EXECUTING" {
+		query = `
+		SELECT p.name, UPPER(p.status::text), p.output, p.results, ''
+		FROM progress AS p JOIN tasks AS t ON (t.id=p.task_id)
+		WHERE t.commit_id=$1 ORDER BY p.id
+		`
+	}
+	rows, err := api.DB.Query(r.Context(), query, commitID)
 	if err != nil {
 		E.Handle(w, r, err)
 		return
@@ -52,13 +67,29 @@ func (api *API) GetCommit(w http.ResponseWriter, r *http.Request) {
 
 	err = db.IterRows(rows, func(rows pgx.Rows) error {
 		var check models.Stage
-		err = rows.Scan(&check.Name, &check.Status, &check.Output)
+		err = rows.Scan(&check.Name, &check.Status, &check.Output, &check.Results, &check.LogKey)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 		resp.Checks = append(resp.Checks, &check)
 		return nil
 	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	// full logs of truncated outputs are downloaded directly from the storage
+	for _, check := range resp.Checks {
+		if check.LogKey == "" {
+			continue
+		}
+		check.LogURL, err = api.Blobs.URL(r.Context(), check.LogKey)
+		if err != nil {
+			E.Handle(w, r, errors.Wrap(err, "could not get log URL"))
+			return
+		}
+	}
 
 	render.JSON(w, r, &resp)
 }
@@ -10,13 +10,13 @@ import (
 	"github.com/pkg/errors"
 )
 
-func (api *API) getTestIds(ctx context.Context, names []string) (map[string]uint64, error) {
+func (api *API) getTestIds(ctx context.Context, courseID uint64, names []string) (map[string]uint64, error) {
 	testNames := &pgtype.TextArray{}
 	_ = testNames.Set(names)
 
 	rows, err := api.DB.Query(ctx, `
-	SELECT id, name FROM tests WHERE name=ANY($1) AND is_deleted='f'
-	`, testNames)
+	SELECT id, name FROM tests WHERE course_id=$1 AND name=ANY($2) AND is_deleted='f'
+	`, courseID, testNames)
 	if err != nil {
 		return nil, errors.Wrap(err, "query error")
 	}
@@ -0,0 +1,361 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/pkg/errors"
+)
+
+func (api *API) GetDeadlines(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	deadlines, err := api.courseDeadlines(r.Context(), course.Id, 0)
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+	render.JSON(w, r, &deadlines)
+}
+
+// UpdateDeadlines replaces deadlines of the course. Extensions of deadlines
+// that remain in place are preserved.
+func (api *API) UpdateDeadlines(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	var deadlines []*models.Deadline
+	if err := render.DecodeJSON(r.Body, &deadlines); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+
+	for _, d := range deadlines {
+		if d.Test != "" && d.Topic != "" {
+			E.SendError(w, r, nil, http.StatusBadRequest, "deadline cannot have both test and topic")
+			return
+		}
+		switch d.LatePolicy {
+		case "":
+			d.LatePolicy = models.LatePolicyReject
+		case models.LatePolicyReject:
+		case models.LatePolicyMultiplier:
+			if d.Multiplier == nil {
+				E.SendError(w, r, nil, http.StatusBadRequest, "late multiplier is required by the multiplier policy")
+				return
+			}
+			if *d.Multiplier < 0 || *d.Multiplier > 1 {
+				E.SendError(w, r, nil, http.StatusBadRequest, "late multiplier must be between 0 and 1")
+				return
+			}
+		default:
+			e := fmt.Errorf("unknown late policy: %s", d.LatePolicy)
+			E.SendError(w, r, e, http.StatusBadRequest, e.Error())
+			return
+		}
+		if d.Multiplier == nil {
+			one := 1.0
+			d.Multiplier = &one
+		}
+	}
+
+	testIds, err := api.getTestIds(r.Context(), course.Id, deadlineTests(deadlines))
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	err = db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+		ids := make([]int64, 0, len(deadlines))
+		for _, d := range deadlines {
+			var (
+				testID *uint64
+				topic  *string
+				id     int64
+			)
+			if d.Test != "" {
+				v, ok := testIds[d.Test]
+				if !ok {
+					e := fmt.Errorf("unknown test: %s", d.Test)
+					return E.New(e, http.StatusBadRequest, e.Error())
+				}
+				testID = &v
+			}
+			if d.Topic != "" {
+				topic = &d.Topic
+			}
+			err := tx.QueryRow(r.Context(), `
+			INSERT INTO deadlines (course_id, test_id, topic, due_at, late_policy, late_multiplier)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (course_id, COALESCE(test_id, 0), COALESCE(topic, '')) DO UPDATE
+			SET due_at=EXCLUDED.due_at,
+				late_policy=EXCLUDED.late_policy,
+				late_multiplier=EXCLUDED.late_multiplier
+			RETURNING id
+			`, course.Id, testID, topic, d.Due, d.LatePolicy, d.Multiplier).Scan(&id)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			ids = append(ids, id)
+		}
+
+		keep := &pgtype.Int8Array{}
+		_ = keep.Set(ids)
+		_, err := tx.Exec(r.Context(), `
+		DELETE FROM deadlines WHERE course_id=$1 AND NOT (id=ANY($2))
+		`, course.Id, keep)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// GrantExtension moves a deadline of the course for a single user
+func (api *API) GrantExtension(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	var ext models.Extension
+	if err := render.DecodeJSON(r.Body, &ext); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+
+	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(r.Context(), `
+		INSERT INTO extensions (deadline_id, user_id, due_at)
+		SELECT d.id, u.id, $5
+		FROM deadlines AS d
+			LEFT JOIN tests AS t ON (t.id=d.test_id),
+			users AS u
+			JOIN enrollments AS e ON (e.user_id=u.id)
+		WHERE d.course_id=$1 AND e.course_id=$1 AND u.login=$2
+			AND COALESCE(t.name, '')=$3 AND COALESCE(d.topic, '')=$4
+		ON CONFLICT (deadline_id, user_id) DO UPDATE
+		SET due_at=EXCLUDED.due_at, granted_at=STATEMENT_TIMESTAMP()
+		`, course.Id, ext.Login, ext.Test, ext.Topic, ext.Due)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if tag.RowsAffected() == 0 {
+			e := fmt.Errorf("unknown user or deadline: %s (test=%q, topic=%q)", ext.Login, ext.Test, ext.Topic)
+			return E.New(e, http.StatusNotFound, e.Error())
+		}
+		return audit(r.Context(), tx, course.Id, "grant_extension", ext.Login, &ext)
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// SeedDeadlines sets the deadline of every course that has no deadlines at
+// all. It supports the former global submission deadline, late commits are
+// not graded. Courses whose staff have configured deadlines are left as they
+// are, even if the course-wide one has been removed.
+func (api *API) SeedDeadlines(ctx context.Context, due time.Time) (int64, error) {
+	tag, err := api.DB.Exec(ctx, `
+	INSERT INTO deadlines (course_id, due_at, late_policy)
+	SELECT co.id, $1, 'reject' FROM courses AS co
+	WHERE NOT EXISTS (SELECT 1 FROM deadlines AS d WHERE d.course_id=co.id)
+	ON CONFLICT (course_id, COALESCE(test_id, 0), COALESCE(topic, '')) DO NOTHING
+	`, due)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func deadlineTests(deadlines []*models.Deadline) []string {
+	names := make([]string, 0, len(deadlines))
+	for _, d := range deadlines {
+		if d.Test != "" {
+			names = append(names, d.Test)
+		}
+	}
+	return names
+}
+
+// courseDeadlines returns deadlines of the course. If userID is not zero,
+// extensions granted to the user are applied.
+func (api *API) courseDeadlines(ctx context.Context, courseID, userID uint64) ([]*models.Deadline, error) {
+	rows, err := api.DB.Query(ctx, `
+	SELECT COALESCE(t.name, ''), COALESCE(d.topic, ''), COALESCE(ex.due_at, d.due_at),
+		d.late_policy, d.late_multiplier, ex.id IS NOT NULL
+	FROM deadlines AS d
+		LEFT JOIN tests AS t ON (t.id=d.test_id)
+		LEFT JOIN extensions AS ex ON (ex.deadline_id=d.id AND ex.user_id=$2)
+	WHERE d.course_id=$1 AND COALESCE(t.is_deleted, 'f')='f'
+	ORDER BY d.due_at, t.name NULLS FIRST, d.topic NULLS FIRST
+	`, courseID, userID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	deadlines := make([]*models.Deadline, 0)
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		d := models.Deadline{}
+		if err := rows.Scan(&d.Test, &d.Topic, &d.Due, &d.LatePolicy, &d.Multiplier, &d.Extended); err != nil {
+			return errors.WithStack(err)
+		}
+		deadlines = append(deadlines, &d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deadlines, nil
+}
+
+// lateness describes which tests of a course a user submits late
+type lateness struct {
+	// tests maps names of late tests to their deadlines
+	tests map[string]*models.Deadline
+	total int
+}
+
+// graded reports whether stages of the test are graded. Stages that do not
+// belong to a test are always graded.
+func (l *lateness) graded(test string) bool {
+	if l == nil {
+		return true
+	}
+	d, ok := l.tests[test]
+	return !ok || d.LatePolicy != models.LatePolicyReject
+}
+
+// apply adjusts the credit of a late stage according to the late policy and
+// notes the missed deadline in its output. It reports whether the stage is
+// graded.
+func (l *lateness) apply(stage *models.Stage) bool {
+	d, ok := l.tests[stage.Test]
+	if !ok {
+		return true
+	}
+	graded := l.graded(stage.Test)
+	if graded {
+		stage.Credit *= *d.Multiplier
+	} else {
+		stage.Credit = 0
+	}
+	stage.Output = strings.TrimSpace(d.LateNote() + "\n\n" + stage.Output)
+	return graded
+}
+
+// rejectsAll reports whether no test of the course would be graded
+func (l *lateness) rejectsAll() bool {
+	if l.total == 0 || len(l.tests) < l.total {
+		return false
+	}
+	for _, d := range l.tests {
+		if d.LatePolicy != models.LatePolicyReject {
+			return false
+		}
+	}
+	return true
+}
+
+// lateSummary explains to the student why a commit has not been graded
+func lateSummary(l *lateness) string {
+	var missed []*models.Deadline
+	seen := map[*models.Deadline]bool{}
+	for _, d := range l.tests {
+		if !seen[d] {
+			seen[d] = true
+			missed = append(missed, d)
+		}
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i].Due.Before(missed[j].Due) })
+
+	var b strings.Builder
+	b.WriteString("This commit was pushed after the following deadlines and will not be graded:\n\n")
+	for _, d := range missed {
+		scope := "all tests"
+		switch {
+		case d.Test != "":
+			scope = fmt.Sprintf("test `%s`", d.Test)
+		case d.Topic != "":
+			scope = fmt.Sprintf("topic `%s`", d.Topic)
+		}
+		b.WriteString(fmt.Sprintf("* %s: %s\n", scope, d.Due.UTC().Format("2006-01-02 15:04 MST")))
+	}
+	return b.String()
+}
+
+// lateTests determines deadlines missed by a submission of the user at the
+// given time. Extensions granted to the user are applied.
+func (api *API) lateTests(ctx context.Context, courseID, userID uint64, at time.Time) (*lateness, error) {
+	deadlines, err := api.courseDeadlines(ctx, courseID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := api.DB.Query(ctx, `
+	SELECT name, topic FROM tests WHERE course_id=$1 AND is_deleted='f'
+	`, courseID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var tests []*models.Test
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		t := models.Test{}
+		if err := rows.Scan(&t.Name, &t.Topic); err != nil {
+			return errors.WithStack(err)
+		}
+		tests = append(tests, &t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missedDeadlines(deadlines, tests, at), nil
+}
+
+// missedDeadlines determines deadlines of the tests missed at the given time.
+// A test deadline takes precedence over a topic one, which in turn takes
+// precedence over the course deadline.
+func missedDeadlines(deadlines []*models.Deadline, tests []*models.Test, at time.Time) *lateness {
+	var course *models.Deadline
+	byTest := map[string]*models.Deadline{}
+	byTopic := map[string]*models.Deadline{}
+	for _, d := range deadlines {
+		switch {
+		case d.Test != "":
+			byTest[d.Test] = d
+		case d.Topic != "":
+			byTopic[d.Topic] = d
+		default:
+			course = d
+		}
+	}
+
+	l := &lateness{tests: map[string]*models.Deadline{}, total: len(tests)}
+	for _, t := range tests {
+		d, ok := byTest[t.Name]
+		if !ok {
+			d, ok = byTopic[t.Topic]
+		}
+		if !ok {
+			d = course
+		}
+		if d != nil && at.After(d.Due) {
+			l.tests[t.Name] = d
+		}
+	}
+	return l
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+func TestMissedDeadlines(t *testing.T) {
+	at := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []*models.Test{
+		{Name: "heap", Topic: "trees"},
+		{Name: "trie", Topic: "trees"},
+		{Name: "sort", Topic: "arrays"},
+		{Name: "hash"},
+	}
+	course := &models.Deadline{Due: at.Add(-time.Hour), LatePolicy: models.LatePolicyReject}
+	trees := &models.Deadline{Topic: "trees", Due: at.Add(time.Hour), LatePolicy: models.LatePolicyReject}
+	trie := &models.Deadline{Test: "trie", Due: at.Add(-time.Minute), LatePolicy: models.LatePolicyMultiplier, Multiplier: multiplier(0.5)}
+	// the extension is already applied to the due time by the query
+	extended := &models.Deadline{Test: "sort", Due: at.Add(24 * time.Hour), LatePolicy: models.LatePolicyReject, Extended: true}
+
+	cases := []struct {
+		name      string
+		deadlines []*models.Deadline
+		late      map[string]*models.Deadline
+	}{
+		{"no deadlines", nil, map[string]*models.Deadline{}},
+		{"course", []*models.Deadline{course}, map[string]*models.Deadline{"heap": course, "trie": course, "sort": course, "hash": course}},
+		{"topic over course", []*models.Deadline{course, trees}, map[string]*models.Deadline{"sort": course, "hash": course}},
+		{"test over topic", []*models.Deadline{course, trees, trie}, map[string]*models.Deadline{"trie": trie, "sort": course, "hash": course}},
+		{"extension", []*models.Deadline{course, extended}, map[string]*models.Deadline{"heap": course, "trie": course, "hash": course}},
+	}
+	for _, c := range cases {
+		l := missedDeadlines(c.deadlines, tests, at)
+		if l.total != len(tests) {
+			t.Errorf("%s: expected %d tests in total, got %d", c.name, len(tests), l.total)
+		}
+		if len(l.tests) != len(c.late) {
+			t.Errorf("%s: expected %d late tests, got %d", c.name, len(c.late), len(l.tests))
+		}
+		for test, d := range c.late {
+			if l.tests[test] != d {
+				t.Errorf("%s: expected %s to miss %+v, got %+v", c.name, test, d, l.tests[test])
+			}
+		}
+	}
+
+	if l := missedDeadlines([]*models.Deadline{course}, tests, course.Due); len(l.tests) != 0 {
+		t.Errorf("expected submissions at the due time to be on time, got %d late tests", len(l.tests))
+	}
+}
+
+func TestRejectsAll(t *testing.T) {
+	reject := &models.Deadline{Due: time.Now(), LatePolicy: models.LatePolicyReject}
+	discount := &models.Deadline{Test: "b", Due: time.Now(), LatePolicy: models.LatePolicyMultiplier, Multiplier: multiplier(0)}
+
+	cases := []struct {
+		name     string
+		late     *lateness
+		rejected bool
+	}{
+		{"no tests", &lateness{tests: map[string]*models.Deadline{}}, false},
+		{"all late", &lateness{tests: map[string]*models.Deadline{"a": reject, "b": reject}, total: 2}, true},
+		{"some late", &lateness{tests: map[string]*models.Deadline{"a": reject}, total: 2}, false},
+		{"discounted", &lateness{tests: map[string]*models.Deadline{"a": reject, "b": discount}, total: 2}, false},
+	}
+	for _, c := range cases {
+		if rejected := c.late.rejectsAll(); rejected != c.rejected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.rejected, rejected)
+		}
+	}
+}
+
+func TestLateSummary(t *testing.T) {
+	at := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	course := &models.Deadline{Due: at.Add(time.Hour), LatePolicy: models.LatePolicyReject}
+	topic := &models.Deadline{Topic: "trees", Due: at, LatePolicy: models.LatePolicyReject}
+	test := &models.Deadline{Test: "sort", Due: at.Add(-time.Hour), LatePolicy: models.LatePolicyReject}
+
+	// deadlines shared by several tests are listed once
+	l := &lateness{tests: map[string]*models.Deadline{"heap": topic, "trie": topic, "sort": test, "hash": course}, total: 4}
+	expected := "This commit was pushed after the following deadlines and will not be graded:\n\n" +
+		"* test `sort`: 2020-03-01 11:00 UTC\n" +
+		"* topic `trees`: 2020-03-01 12:00 UTC\n" +
+		"* all tests: 2020-03-01 13:00 UTC\n"
+	if s := lateSummary(l); s != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, s)
+	}
+}
+
+func TestLateCredit(t *testing.T) {
+	test := &models.Test{
+		Name:     "heap",
+		Policy:   models.PolicyProportional,
+		Subtests: []*models.Subtest{{Name: "push", Weight: 1}, {Name: "pop", Weight: 1}},
+	}
+	partial := &models.Run{Test: "heap", Status: "failure", Results: []*models.TestResult{
+		{Name: "TestHeap/push", Status: "pass"}, {Name: "TestHeap/pop", Status: "fail"},
+	}}
+	full := &models.Run{Test: "heap", Status: "success"}
+
+	due := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	reject := &models.Deadline{Due: due, LatePolicy: models.LatePolicyReject}
+	half := &models.Deadline{Due: due, LatePolicy: models.LatePolicyMultiplier, Multiplier: multiplier(0.5)}
+	zero := &models.Deadline{Due: due, LatePolicy: models.LatePolicyMultiplier, Multiplier: multiplier(0)}
+
+	cases := []struct {
+		name     string
+		run      *models.Run
+		deadline *models.Deadline
+		credit   float64
+		graded   bool
+	}{
+		{"on time", full, nil, 1, true},
+		{"partial on time", partial, nil, 0.5, true},
+		{"late full", full, half, 0.5, true},
+		{"late partial", partial, half, 0.25, true},
+		{"late with zero multiplier", full, zero, 0, true},
+		{"rejected", full, reject, 0, false},
+	}
+	for _, c := range cases {
+		c.run.Credit = test.Credit(c.run)
+		stage := &models.Stage{}
+		stage.FillFromRun("test", c.run)
+
+		late := &lateness{tests: map[string]*models.Deadline{}, total: 1}
+		if c.deadline != nil {
+			late.tests["heap"] = c.deadline
+		}
+		graded := late.apply(stage)
+		if stage.Credit != c.credit || graded != c.graded {
+			t.Errorf("%s: expected credit %v (graded: %v), got %v (graded: %v)", c.name, c.credit, c.graded, stage.Credit, graded)
+		}
+		if c.deadline != nil && !strings.HasPrefix(stage.Output, c.deadline.LateNote()) {
+			t.Errorf("%s: expected the late note in the output, got %q", c.name, stage.Output)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/jackc/pgx/v4"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/mkuznets/classbox/pkg/github"
+	"github.com/pkg/errors"
+)
+
+// Outcomes of webhook deliveries
+const (
+	deliveryProcessed = "processed" // a check has been requested
+	deliveryIgnored   = "ignored"   // the event does not require a check
+	deliveryFailed    = "failed"
+)
+
+// Rejected webhooks as well as processed and ignored deliveries are kept for
+// webhookRetention and pruned every pruneInterval
+const (
+	webhookRetention = 30 * 24 * time.Hour
+	pruneInterval    = time.Hour
+)
+
+// claimTimeout is the time after which a delivery that is still being
+// processed, e.g. by a crashed server, can be taken by a redelivery
+const claimTimeout = 5 * time.Minute
+
+// delivery is a webhook stored for processing
+type delivery struct {
+	id         uint64
+	deliveryID string
+	event      string
+	payload    []byte
+}
+
+// hookCommit is a commit to be checked as requested by a Github webhook
+type hookCommit struct {
+	Head        string
+	Repo        *github.Repo
+	Sender      *github.User
+	Inst        *github.Installation
+	Pull        int  // number of the pull request, if any
+	Rerequested bool // the user asked to check the commit again
+}
+
+// parseHook extracts the commit to check from a check_suite, check_run, push
+// or pull_request webhook. Nil is returned for events that do not require
+// a check.
+func (api *API) parseHook(event string, payload []byte) (*hookCommit, error) {
+	var hc hookCommit
+
+	switch event {
+	case "check_suite":
+		ev := github.CheckSuiteEvent{}
+		if err := json.Unmarshal(payload, &ev); err != nil || ev.CheckSuite == nil {
+			return nil, E.New(err, http.StatusBadRequest, "invalid input")
+		}
+		switch ev.Action {
+		case "rerequested":
+			hc.Rerequested = true
+		case "requested":
+			// pushes are graded by push events instead
+			if len(api.PushBranches) > 0 {
+				return nil, nil
+			}
+		default:
+			return nil, nil
+		}
+		hc.Head, hc.Repo, hc.Sender, hc.Inst = ev.CheckSuite.Head, ev.Repo, ev.Sender, ev.Inst
+
+	case "check_run":
+		// Re-runs of any check run, including those of tests or topics,
+		// regrade the whole commit
+		ev := github.CheckRunEvent{}
+		if err := json.Unmarshal(payload, &ev); err != nil || ev.CheckRun == nil {
+			return nil, E.New(err, http.StatusBadRequest, "invalid input")
+		}
+		if ev.Action != "rerequested" {
+			return nil, nil
+		}
+		hc.Rerequested = true
+		hc.Head, hc.Repo, hc.Sender, hc.Inst = ev.CheckRun.Commit, ev.Repo, ev.Sender, ev.Inst
+
+	case "push":
+		if len(api.PushBranches) == 0 {
+			return nil, nil
+		}
+		ev := github.PushEvent{}
+		if err := json.Unmarshal(payload, &ev); err != nil {
+			return nil, E.New(err, http.StatusBadRequest, "invalid input")
+		}
+		if ev.Deleted || !api.gradedBranch(ev.Ref) {
+			return nil, nil
+		}
+		hc.Head, hc.Repo, hc.Sender, hc.Inst = ev.After, ev.Repo, ev.Sender, ev.Inst
+
+	case "pull_request":
+		if !api.PullRequests {
+			return nil, nil
+		}
+		ev := github.PullRequestEvent{}
+		if err := json.Unmarshal(payload, &ev); err != nil || ev.PullRequest == nil || ev.PullRequest.Head == nil {
+			return nil, E.New(err, http.StatusBadRequest, "invalid input")
+		}
+		switch ev.Action {
+		case "opened", "reopened", "synchronize":
+		default:
+			return nil, nil
+		}
+		// Check runs are created in the repository the pull request is
+		// opened against, which has to be the enrolled one.
+		hc.Head, hc.Repo, hc.Sender, hc.Inst = ev.PullRequest.Head.Sha, ev.Repo, ev.Sender, ev.Inst
+		hc.Pull = ev.Number
+
+	default:
+		return nil, nil
+	}
+
+	if hc.Head == "" || hc.Repo == nil || hc.Repo.Owner == nil || hc.Sender == nil || hc.Inst == nil {
+		return nil, E.New(nil, http.StatusBadRequest, "invalid input")
+	}
+	return &hc, nil
+}
+
+// gradedBranch reports whether pushes to the ref are graded
+func (api *API) gradedBranch(ref string) bool {
+	if !strings.HasPrefix(ref, "refs/heads/") {
+		return false
+	}
+	branch := strings.TrimPrefix(ref, "refs/heads/")
+	for _, b := range api.PushBranches {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewSummary lists failed stages for a pull request review
+func (api *API) reviewSummary(courseName, login, commitHash string, stages []*models.Stage) (string, error) {
+	page := struct {
+		Course, Commit, Url string
+		Stages              []*models.Stage
+	}{courseName, commitHash, api.commitURL(courseName, login, commitHash), stages}
+	return renderMarkdown("pull_review", page)
+}
+
+// saveDelivery stores a webhook and claims it for processing. Nil is returned
+// for deliveries that have already been processed or ignored, or are being
+// processed. Github keeps the delivery id of redeliveries, so failed
+// deliveries and the ones that have been claimed longer than claimTimeout
+// ago are processed again.
+func (api *API) saveDelivery(ctx context.Context, header http.Header, body []byte) (*delivery, error) {
+	d := delivery{
+		deliveryID: header.Get("X-GitHub-Delivery"),
+		event:      header.Get("X-GitHub-Event"),
+		payload:    body,
+	}
+	if d.deliveryID == "" || d.event == "" {
+		return nil, E.New(nil, http.StatusBadRequest, "delivery id and event are required")
+	}
+
+	var ev struct {
+		Repo *github.Repo `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, E.New(err, http.StatusBadRequest, "invalid input")
+	}
+	var repoID *int
+	if ev.Repo != nil {
+		repoID = &ev.Repo.ID
+	}
+
+	err := api.DB.QueryRow(ctx, `
+	INSERT INTO webhook_deliveries (delivery_id, event, headers, payload, repository_id)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (delivery_id) DO UPDATE SET status='received', error=NULL, claimed_at=STATEMENT_TIMESTAMP()
+	WHERE webhook_deliveries.status='failed' OR (webhook_deliveries.status='received'
+		AND webhook_deliveries.claimed_at < STATEMENT_TIMESTAMP() - $6 * interval '1 second')
+	RETURNING id
+	`, d.deliveryID, d.event, header, body, repoID, claimTimeout.Seconds()).Scan(&d.id)
+	switch {
+	case err == pgx.ErrNoRows:
+		log.Printf("[INFO] Webhook %s has already been processed or is being processed", d.deliveryID)
+		return nil, nil
+	case err != nil:
+		return nil, errors.WithStack(err)
+	}
+	return &d, nil
+}
+
+// processDelivery checks the commit of a stored webhook and records the
+// outcome of the delivery.
+func (api *API) processDelivery(ctx context.Context, d *delivery) error {
+	log.Printf("[INFO] Webhook %s (%s)", d.deliveryID, d.event)
+
+	status := deliveryIgnored
+	hc, err := api.parseHook(d.event, d.payload)
+	if err == nil && hc != nil {
+		status, err = api.enqueueHook(ctx, hc)
+	}
+
+	var errText *string
+	if err != nil {
+		status = deliveryFailed
+		msg := err.Error()
+		if e, ok := err.(*E.APIError); ok && e.Err != nil {
+			msg = fmt.Sprintf("%s: %v", e.Msg, e.Err)
+		}
+		errText = &msg
+	}
+
+	_, uerr := api.DB.Exec(ctx, `
+	UPDATE webhook_deliveries
+	SET status=$2, error=$3, attempts=attempts+1, processed_at=STATEMENT_TIMESTAMP()
+	WHERE id=$1
+	`, d.id, status, errText)
+	if uerr != nil {
+		log.Printf("[WARN] could not save outcome of webhook %s: %v", d.deliveryID, uerr)
+	}
+	return err
+}
+
+// GetWebhooks lists the latest webhook deliveries for repositories of the
+// course and for repositories that are not enrolled in any course.
+func (api *API) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	limit, err := listLimit(r)
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	rows, err := api.DB.Query(r.Context(), `
+	SELECT d.delivery_id, d.event, d.status::text, COALESCE(d.error, ''), d.attempts, d.received_at, d.processed_at
+	FROM webhook_deliveries AS d
+		LEFT JOIN enrollments AS e ON (e.repository_id=d.repository_id)
+	WHERE e.course_id=$1 OR e.course_id IS NULL
+	ORDER BY d.id DESC
+	LIMIT $2
+	`, course.Id, limit)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	deliveries := make([]*models.WebhookDelivery, 0)
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		d := models.WebhookDelivery{}
+		if err := rows.Scan(&d.DeliveryId, &d.Event, &d.Status, &d.Error, &d.Attempts, &d.ReceivedAt, &d.ProcessedAt); err != nil {
+			return errors.WithStack(err)
+		}
+		deliveries = append(deliveries, &d)
+		return nil
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, &deliveries)
+}
+
+// ReplayWebhook processes a stored webhook delivery again, e.g. after a fix
+// of the processing. The delivery goes through the same checks as a new one,
+// so commits that have already been checked are not checked again.
+func (api *API) ReplayWebhook(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+	deliveryID := chi.URLParam(r, "deliveryID")
+
+	d := delivery{deliveryID: deliveryID}
+	err := api.DB.QueryRow(r.Context(), `
+	SELECT d.id, d.event, d.payload
+	FROM webhook_deliveries AS d
+		LEFT JOIN enrollments AS e ON (e.repository_id=d.repository_id)
+	WHERE d.delivery_id=$1 AND (e.course_id=$2 OR e.course_id IS NULL)
+	`, deliveryID, course.Id).Scan(&d.id, &d.event, &d.payload)
+	switch {
+	case err == pgx.ErrNoRows:
+		e := fmt.Errorf("unknown delivery: %s", deliveryID)
+		E.SendError(w, r, e, http.StatusNotFound, e.Error())
+		return
+	case err != nil:
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	// Replays are not processed concurrently with the delivery itself
+	tag, err := api.DB.Exec(r.Context(), `
+	UPDATE webhook_deliveries SET status='received', claimed_at=STATEMENT_TIMESTAMP()
+	WHERE id=$1 AND (status<>'received' OR claimed_at < STATEMENT_TIMESTAMP() - $2 * interval '1 second')
+	`, d.id, claimTimeout.Seconds())
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		E.SendError(w, r, nil, http.StatusConflict, "the delivery is being processed")
+		return
+	}
+
+	// The outcome is saved with the delivery and returned below
+	if err := api.processDelivery(r.Context(), &d); err != nil {
+		log.Printf("[WARN] replay of webhook %s failed: %v", deliveryID, err)
+	}
+
+	res := models.WebhookDelivery{DeliveryId: deliveryID, Event: d.event}
+	err = db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+		err := tx.QueryRow(r.Context(), `
+		SELECT status::text, COALESCE(error, ''), attempts, received_at, processed_at
+		FROM webhook_deliveries WHERE id=$1
+		`, d.id).Scan(&res.Status, &res.Error, &res.Attempts, &res.ReceivedAt, &res.ProcessedAt)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return audit(r.Context(), tx, course.Id, "replay_webhook", deliveryID, map[string]string{"status": res.Status})
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, &res)
+}
+
+// PruneWebhooks periodically deletes rejected webhooks, and processed and
+// ignored deliveries older than webhookRetention. Failed deliveries are kept
+// to be replayed.
+func (api *API) PruneWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		if err := api.pruneWebhooks(ctx); err != nil {
+			log.Printf("[ERR] could not prune webhooks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (api *API) pruneWebhooks(ctx context.Context) error {
+	_, err := api.DB.Exec(ctx, `
+	DELETE FROM webhook_rejections WHERE received_at < STATEMENT_TIMESTAMP() - $1 * interval '1 second'
+	`, webhookRetention.Seconds())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = api.DB.Exec(ctx, `
+	DELETE FROM webhook_deliveries
+	WHERE status IN ('processed', 'ignored') AND received_at < STATEMENT_TIMESTAMP() - $1 * interval '1 second'
+	`, webhookRetention.Seconds())
+	return errors.WithStack(err)
+}
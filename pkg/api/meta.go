@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/go-chi/render"
@@ -15,10 +17,12 @@ import (
 )
 
 func (api *API) GetTests(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	rows, err := api.DB.Query(r.Context(), `
-	SELECT name, description, topic, score FROM tests WHERE is_deleted='f' ORDER BY name
-	`)
+	SELECT name, description, topic, score, policy, subtests, perf, timeout, memory, cpus, pids
+	FROM tests WHERE course_id=$1 AND is_deleted='f' ORDER BY name
+	`, course.Id)
 	if err != nil {
 		E.Handle(w, r, errors.WithStack(err))
 		return
@@ -28,7 +32,7 @@ func (api *API) GetTests(w http.ResponseWriter, r *http.Request) {
 
 	err = db.IterRows(rows, func(rows pgx.Rows) error {
 		t := models.Test{}
-		if err := rows.Scan(&t.Name, &t.Description, &t.Topic, &t.Score); err != nil {
+		if err := rows.Scan(&t.Name, &t.Description, &t.Topic, &t.Score, &t.Policy, &t.Subtests, &t.Perf, &t.Timeout, &t.Memory, &t.Cpus, &t.Pids); err != nil {
 			return errors.WithStack(err)
 		}
 		tests = append(tests, &t)
@@ -43,6 +47,7 @@ func (api *API) GetTests(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) UpdateTests(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	var tests []models.Test
 
@@ -51,25 +56,49 @@ func (api *API) UpdateTests(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, test := range tests {
+	for i, test := range tests {
 		if test.Name == "" {
 			E.SendError(w, r, nil, http.StatusBadRequest, "test name cannot be empty")
 			return
 		}
+		switch test.Policy {
+		case "":
+			tests[i].Policy = models.PolicyAllOrNothing
+		case models.PolicyAllOrNothing, models.PolicyProportional:
+		default:
+			e := fmt.Errorf("unknown score policy of `%s`: %s", test.Name, test.Policy)
+			E.SendError(w, r, e, http.StatusBadRequest, e.Error())
+			return
+		}
+		if test.Perf != nil {
+			if err := test.Perf.Validate(); err != nil {
+				e := fmt.Errorf("invalid perf policy of `%s`: %v", test.Name, err)
+				E.SendError(w, r, e, http.StatusBadRequest, e.Error())
+				return
+			}
+		}
 	}
 
 	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
 		for _, test := range tests {
 			_, err := tx.Exec(r.Context(), `
-			INSERT INTO tests (name, description, topic, score)
-			VALUES ($1, $2, $3, $4)
-			ON CONFLICT ("name") DO UPDATE
+			INSERT INTO tests (course_id, name, description, topic, score, policy, subtests, perf, timeout, memory, cpus, pids)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (course_id, name) DO UPDATE
 			SET name=EXCLUDED.name,
 				description=EXCLUDED.description,
 				topic=EXCLUDED.topic,
 				score=EXCLUDED.score,
+				policy=EXCLUDED.policy,
+				subtests=EXCLUDED.subtests,
+				perf=EXCLUDED.perf,
+				timeout=EXCLUDED.timeout,
+				memory=EXCLUDED.memory,
+				cpus=EXCLUDED.cpus,
+				pids=EXCLUDED.pids,
 				is_deleted='f'
-			`, test.Name, test.Description, test.Topic, test.Score)
+			`, course.Id, test.Name, test.Description, test.Topic, test.Score, test.Policy, test.Subtests, test.Perf,
+				test.Timeout, test.Memory, test.Cpus, test.Pids)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -78,7 +107,9 @@ func (api *API) UpdateTests(w http.ResponseWriter, r *http.Request) {
 		testNames := &pgtype.TextArray{}
 		_ = testNames.Set(utils.UniqueStringFields(tests, "Name"))
 
-		_, err := tx.Exec(r.Context(), `UPDATE tests SET is_deleted='t' WHERE NOT (name=ANY($1))`, testNames)
+		_, err := tx.Exec(r.Context(), `
+		UPDATE tests SET is_deleted='t' WHERE course_id=$1 AND NOT (name=ANY($2))
+		`, course.Id, testNames)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -93,41 +124,68 @@ func (api *API) UpdateTests(w http.ResponseWriter, r *http.Request) {
 	render.NoContent(w, r)
 }
 
-func (api *API) GetCourse(w http.ResponseWriter, r *http.Request) {
-	var course models.Course
-	err := api.DB.QueryRow(r.Context(), `SELECT updated_at, is_ready FROM courses WHERE name='stdlib' LIMIT 1`).Scan(&course.Update, &course.Ready)
-	switch {
-	case err == pgx.ErrNoRows:
-		e := fmt.Errorf("no courses found")
-		E.SendError(w, r, e, http.StatusNotFound, e.Error())
+func (api *API) GetCourses(w http.ResponseWriter, r *http.Request) {
+
+	rows, err := api.DB.Query(r.Context(), `
+	SELECT name, repository_name, updated_at, is_ready FROM courses ORDER BY id
+	`)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
 		return
-	case err != nil:
+	}
+
+	courses := make([]*models.Course, 0)
+
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		c := models.Course{}
+		if err := rows.Scan(&c.Name, &c.RepoName, &c.Update, &c.Ready); err != nil {
+			return errors.WithStack(err)
+		}
+		courses = append(courses, &c)
+		return nil
+	})
+	if err != nil {
 		E.Handle(w, r, err)
 		return
 	}
-	render.JSON(w, r, &course)
+
+	render.JSON(w, r, &courses)
+}
+
+func (api *API) GetCourse(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+	render.JSON(w, r, course)
 }
 
 func (api *API) UpdateCourse(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
-	var course models.Course
-	if err := render.DecodeJSON(r.Body, &course); err != nil {
+	var data models.Course
+	if err := render.DecodeJSON(r.Body, &data); err != nil {
 		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
 		return
 	}
 
 	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
 		_, err := tx.Exec(r.Context(), `
-		INSERT INTO courses (name, updated_at, is_ready)
-		VALUES ('stdlib', STATEMENT_TIMESTAMP(), $1)
-		ON CONFLICT ("name") DO UPDATE
-		SET name=EXCLUDED.name,
-			updated_at=EXCLUDED.updated_at,
-			is_ready=EXCLUDED.is_ready
-		`, course.Ready)
+		UPDATE courses SET updated_at=STATEMENT_TIMESTAMP(), is_ready=$2 WHERE id=$1
+		`, course.Id, data.Ready)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		if !data.Ready {
+			return nil
+		}
+
+		changed, err := updateVersion(r.Context(), tx, course.Id)
+		if err != nil || !changed || !data.Regrade {
+			return err
+		}
+		n, err := regradeCourse(r.Context(), tx, course.Id)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] %s: enqueued %d commits for regrade", course.Name, n)
 		return nil
 	})
 	if err != nil {
@@ -136,3 +194,91 @@ func (api *API) UpdateCourse(w http.ResponseWriter, r *http.Request) {
 	}
 	render.NoContent(w, r)
 }
+
+// updateVersion bumps the course version if tests or their baselines have
+// changed since the previous version.
+func updateVersion(ctx context.Context, tx pgx.Tx, courseID uint64) (bool, error) {
+	var fingerprint, previous string
+	err := tx.QueryRow(ctx, `
+	SELECT
+		(SELECT md5(COALESCE(string_agg(
+			(t.name, t.score, t.policy, t.subtests, t.perf, t.timeout, t.memory, t.cpus, t.pids, b.hash)::text,
+			',' ORDER BY t.name), ''))
+		FROM tests AS t LEFT JOIN LATERAL (
+			SELECT r.hash FROM runs AS r
+			WHERE r.test_id=t.id AND r.is_baseline='t' AND r.status='success'
+			ORDER BY r.id DESC LIMIT 1
+		) AS b ON (true)
+		WHERE t.course_id=$1 AND t.is_deleted='f'),
+		fingerprint
+	FROM courses WHERE id=$1 FOR UPDATE
+	`, courseID).Scan(&fingerprint, &previous)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if fingerprint == previous {
+		return false, nil
+	}
+
+	// The fingerprint of a course that has not been versioned yet is unknown,
+	// keep its version as it is.
+	var bump int
+	if previous != "" {
+		bump = 1
+	}
+	_, err = tx.Exec(ctx, `
+	UPDATE courses SET fingerprint=$2, version=version+$3 WHERE id=$1
+	`, courseID, fingerprint, bump)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return bump > 0, nil
+}
+
+// regradeCourse enqueues the latest graded commit of each user at low
+// priority, unless the user has another commit in the queue. Commits keep
+// their check runs.
+func regradeCourse(ctx context.Context, tx pgx.Tx, courseID uint64) (int, error) {
+	rows, err := tx.Query(ctx, `
+	SELECT DISTINCT ON (c.user_id) c.user_id, c.commit, c.check_run_id
+	FROM commits AS c
+		JOIN tasks AS t ON (t.commit_id=c.id)
+		JOIN users AS u ON (u.id=c.user_id)
+	WHERE c.course_id=$1 AND t.status='finished' AND u.installation_id IS NOT NULL
+		AND EXISTS (
+			SELECT 1 FROM checks AS ch WHERE ch.commit_id=c.id AND ch.test_id IS NOT NULL AND ch.is_graded
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM commits AS c2 JOIN tasks AS t2 ON (t2.commit_id=c2.id)
+			WHERE c2.user_id=c.user_id AND c2.course_id=c.course_id AND t2.status IN ('enqueued', 'executing')
+		)
+	ORDER BY c.user_id, c.submitted_at DESC, c.id DESC
+	`, courseID)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	type commit struct {
+		userID, checkRunID uint64
+		hash               string
+	}
+	var commits []commit
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		var c commit
+		if err := rows.Scan(&c.userID, &c.hash, &c.checkRunID); err != nil {
+			return errors.WithStack(err)
+		}
+		commits = append(commits, c)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range commits {
+		if _, err := enqueueCommit(ctx, tx, c.userID, courseID, c.hash, c.checkRunID, priorityRegrade, originRegrade); err != nil {
+			return 0, err
+		}
+	}
+	return len(commits), nil
+}
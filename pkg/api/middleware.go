@@ -5,14 +5,19 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	E "github.com/mkuznets/classbox/pkg/api/errors"
@@ -22,19 +27,92 @@ import (
 
 var expirationLimit = 30 * time.Minute
 
-func checkHookSignature(secret, signature string, body []byte) (bool, error) {
-	requestMac, err := hex.DecodeString(strings.TrimPrefix(signature, "sha1="))
+// checkHookSignature checks a "sha256=..." or "sha1=..." signature of the
+// webhook body against each of the secrets
+func checkHookSignature(secrets []string, signature string, body []byte) bool {
+	var newHash func() hash.Hash
+	switch {
+	case strings.HasPrefix(signature, "sha256="):
+		newHash = sha256.New
+	case strings.HasPrefix(signature, "sha1="):
+		newHash = sha1.New
+	default:
+		return false
+	}
+	requestMac, err := hex.DecodeString(signature[strings.Index(signature, "=")+1:])
 	if err != nil {
-		return false, errors.WithStack(err)
+		return false
+	}
+	for _, secret := range secrets {
+		mac := hmac.New(newHash, []byte(secret))
+		mac.Write(body) // never returns an error
+		if hmac.Equal(requestMac, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRejectionsPerMinute limits the rejected webhooks saved for auditing, as
+// anyone can send them
+const maxRejectionsPerMinute = 30
+
+// rejectedHookHeaders are the headers of rejected webhooks kept for auditing
+var rejectedHookHeaders = []string{
+	"User-Agent", "Content-Type", "X-GitHub-Delivery", "X-GitHub-Event", "X-GitHub-Hook-ID",
+	"X-GitHub-Hook-Installation-Target-ID", "X-Hub-Signature", "X-Hub-Signature-256",
+}
+
+// rejectionSampler lets through at most maxRejectionsPerMinute rejections
+// per minute
+type rejectionSampler struct {
+	mu      sync.Mutex
+	start   time.Time
+	count   int
+	dropped int
+}
+
+var rejections rejectionSampler
+
+func (s *rejectionSampler) allow(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.start) >= time.Minute {
+		if s.dropped > 0 {
+			log.Printf("[WARN] %d webhook rejections were not saved", s.dropped)
+		}
+		s.start, s.count, s.dropped = now, 0, 0
+	}
+	if s.count >= maxRejectionsPerMinute {
+		s.dropped++
+		return false
 	}
-	mac := hmac.New(sha1.New, []byte(secret))
-	if _, err := mac.Write(body); err != nil {
-		return false, errors.WithStack(err)
+	s.count++
+	return true
+}
+
+// saveRejection records a rejected webhook. The payload is not trusted, so
+// only its size is kept.
+func saveRejection(r *http.Request, db *pgxpool.Pool, reason string, size int) {
+	headers := make(map[string]string)
+	for _, h := range rejectedHookHeaders {
+		if v := r.Header.Get(h); v != "" {
+			headers[h] = v
+		}
+	}
+	_, err := db.Exec(r.Context(), `
+	INSERT INTO webhook_rejections (delivery_id, event, reason, remote_addr, headers, payload_size)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`, r.Header.Get("X-GitHub-Delivery"), r.Header.Get("X-GitHub-Event"), reason, r.RemoteAddr, headers, size)
+	if err != nil {
+		log.Printf("[ERR] could not save webhook rejection: %v", err)
 	}
-	return hmac.Equal(requestMac, mac.Sum(nil)), nil
 }
 
-func hookValidator(secret string) func(next http.Handler) http.Handler {
+// hookValidator rejects webhooks without a valid X-Hub-Signature-256 header.
+// The legacy X-Hub-Signature header is only checked if allowSHA1 is set and
+// the former is missing. A sample of rejections is saved for auditing.
+func hookValidator(db *pgxpool.Pool, secrets []string, allowSHA1 bool) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			body, err := ioutil.ReadAll(r.Body)
@@ -46,13 +124,24 @@ func hookValidator(secret string) func(next http.Handler) http.Handler {
 			//noinspection GoUnhandledErrorResult
 			defer r.Body.Close()
 
-			signature := r.Header.Get("X-Hub-Signature")
-			ok, err := checkHookSignature(secret, signature, body)
-			if err != nil {
-				E.Handle(w, r, errors.Wrap(err, "could not check signature"))
-				return
+			var reason string
+			if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+				if !checkHookSignature(secrets, signature, body) {
+					reason = "invalid sha256 signature"
+				}
+			} else if signature := r.Header.Get("X-Hub-Signature"); signature != "" && allowSHA1 {
+				if !checkHookSignature(secrets, signature, body) {
+					reason = "invalid sha1 signature"
+				}
+			} else {
+				reason = "missing signature"
 			}
-			if !ok {
+
+			if reason != "" {
+				log.Printf("[WARN] Webhook %s rejected: %s", r.Header.Get("X-GitHub-Delivery"), reason)
+				if rejections.allow(time.Now()) {
+					saveRejection(r, db, reason, len(body))
+				}
 				E.SendError(w, r, nil, http.StatusUnauthorized, "webhook signature is invalid")
 				return
 			}
@@ -90,6 +179,33 @@ func jwtValidator(keyFunc func(token *jwt.Token) (interface{}, error)) func(next
 	}
 }
 
+func courseCtx(db *pgxpool.Pool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := chi.URLParam(r, "course")
+			var course models.Course
+			err := db.QueryRow(r.Context(), `
+			SELECT id, name, template, repository_name, updated_at, is_ready
+			FROM courses WHERE name=$1 LIMIT 1
+			`, name).Scan(&course.Id, &course.Name, &course.Template, &course.RepoName, &course.Update, &course.Ready)
+			switch {
+			case err == pgx.ErrNoRows:
+				e := fmt.Errorf("unknown course: %s", name)
+				E.SendError(w, r, e, http.StatusNotFound, e.Error())
+				return
+			case err != nil:
+				E.Handle(w, r, err)
+				return
+			}
+			ctx := context.WithValue(r.Context(), "Course", &course)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// userAuth authenticates the user by session and looks up their repository
+// in the current course. Users who are not enrolled in the course are treated
+// as anonymous.
 func userAuth(db *pgxpool.Pool) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -98,12 +214,16 @@ func userAuth(db *pgxpool.Pool) func(next http.Handler) http.Handler {
 				next.ServeHTTP(w, r)
 				return
 			}
+			course := r.Context().Value("Course").(*models.Course)
+
 			var user models.User
 			err := db.QueryRow(r.Context(), `
-			SELECT u.id, u.login, u.repository_name
-			FROM users as u JOIN sessions as s ON (s.user_id=u.id)
-			WHERE session=$1 LIMIT 1
-			`, session).Scan(&user.Id, &user.Login, &user.Repo)
+			SELECT u.id, u.login, e.repository_name
+			FROM users as u
+				JOIN sessions as s ON (s.user_id=u.id)
+				JOIN enrollments as e ON (e.user_id=u.id)
+			WHERE session=$1 AND e.course_id=$2 LIMIT 1
+			`, session, course.Id).Scan(&user.Id, &user.Login, &user.Repo)
 			switch {
 			case err == pgx.ErrNoRows:
 				next.ServeHTTP(w, r)
@@ -117,3 +237,60 @@ func userAuth(db *pgxpool.Pool) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// staffAuth authenticates the user by session and requires one of the given
+// roles in the current course.
+func staffAuth(db *pgxpool.Pool, roles ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := r.Header.Get("X-Session")
+			if session == "" {
+				E.SendError(w, r, nil, http.StatusUnauthorized, "user not authenticated")
+				return
+			}
+			course := r.Context().Value("Course").(*models.Course)
+
+			user, err := staffUser(r.Context(), db, session, course.Id)
+			if err != nil {
+				E.Handle(w, r, err)
+				return
+			}
+			if user == nil {
+				E.SendError(w, r, nil, http.StatusForbidden, "course staff only")
+				return
+			}
+
+			allowed := false
+			for _, role := range roles {
+				allowed = allowed || user.Role == role
+			}
+			if !allowed {
+				E.SendError(w, r, nil, http.StatusForbidden, fmt.Sprintf("not allowed for %s", user.Role))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "User", user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// staffUser returns the user of the session if they have a role in the
+// course, or nil otherwise.
+func staffUser(ctx context.Context, db *pgxpool.Pool, session string, courseID uint64) (*models.User, error) {
+	var user models.User
+	err := db.QueryRow(ctx, `
+	SELECT u.id, u.login, ro.role
+	FROM users as u
+		JOIN sessions as s ON (s.user_id=u.id)
+		JOIN roles as ro ON (ro.user_id=u.id)
+	WHERE session=$1 AND s.expires_at > STATEMENT_TIMESTAMP() AND ro.course_id=$2 LIMIT 1
+	`, session, courseID).Scan(&user.Id, &user.Login, &user.Role)
+	switch {
+	case err == pgx.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, errors.WithStack(err)
+	}
+	return &user, nil
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"testing"
+	"time"
+)
+
+func sign(newHash func() hash.Hash, prefix, secret string, body []byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckHookSignature(t *testing.T) {
+	body := []byte(`{"action":"completed"}`)
+	secrets := []string{"old", "new"}
+
+	cases := []struct {
+		name      string
+		signature string
+		valid     bool
+	}{
+		{"sha256", sign(sha256.New, "sha256=", "new", body), true},
+		{"sha256 previous secret", sign(sha256.New, "sha256=", "old", body), true},
+		{"sha1", sign(sha1.New, "sha1=", "new", body), true},
+		{"sha256 unknown secret", sign(sha256.New, "sha256=", "other", body), false},
+		{"sha256 other body", sign(sha256.New, "sha256=", "new", []byte("{}")), false},
+		{"sha1 digest as sha256", "sha256=" + sign(sha1.New, "", "new", body), false},
+		{"unknown algorithm", sign(sha256.New, "md5=", "new", body), false},
+		{"no prefix", sign(sha256.New, "", "new", body), false},
+		{"not hex", "sha256=zz", false},
+		{"empty", "", false},
+	}
+	for _, c := range cases {
+		if valid := checkHookSignature(secrets, c.signature, body); valid != c.valid {
+			t.Errorf("%s: expected %v, got %v", c.name, c.valid, valid)
+		}
+	}
+
+	if checkHookSignature(nil, sign(sha256.New, "sha256=", "", body), body) {
+		t.Error("expected no signature to be valid without secrets")
+	}
+}
+
+func TestRejectionSampler(t *testing.T) {
+	var s rejectionSampler
+	at := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < maxRejectionsPerMinute; i++ {
+		if !s.allow(at.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("expected rejection %d to be allowed", i)
+		}
+	}
+	if s.allow(at.Add(59 * time.Second)) {
+		t.Error("expected rejections over the limit to be dropped")
+	}
+	if !s.allow(at.Add(time.Minute)) {
+		t.Error("expected rejections to be allowed in the next minute")
+	}
+}
@@ -1,26 +1,162 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	PolicyAllOrNothing = "all-or-nothing"
+	PolicyProportional = "proportional"
+)
+
 type Test struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Topic       string `json:"topic"`
-	Score       uint64 `json:"score"`
-	Passed      bool   `json:"is_passed,omitempty"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Topic       string      `json:"topic"`
+	Score       uint64      `json:"score"`
+	Policy      string      `json:"policy,omitempty"`
+	Subtests    []*Subtest  `json:"subtests,omitempty"`
+	Perf        *PerfPolicy `json:"perf,omitempty"`
+	Passed      bool        `json:"is_passed,omitempty"`
+	Earned      float64     `json:"earned,omitempty"`
+	Stale       bool        `json:"is_stale,omitempty"`
+	Limits
+}
+
+// Subtest is a weighted subtest that gives partial credit under the
+// proportional policy. Name is either a full subtest name (TestUnit/empty)
+// or its last part (empty).
+type Subtest struct {
+	Name   string `json:"name"`
+	Weight uint64 `json:"weight"`
+}
+
+// Credit returns the fraction of the test score earned by the run. Under the
+// proportional policy a failed test is credited for the weights of passed
+// subtests, unless the failure is not attributed to any of them (e.g. slow
+// performance), in which case no credit is given.
+func (t *Test) Credit(run *Run) float64 {
+	if run.Status == "success" {
+		return 1 + run.Bonus
+	}
+	if t.Policy != PolicyProportional {
+		return 0
+	}
+
+	var total, earned uint64
+	for _, s := range t.Subtests {
+		total += s.Weight
+		for _, r := range run.Results {
+			if r.Status == "pass" && (r.Name == s.Name || strings.HasSuffix(r.Name, "/"+s.Name)) {
+				earned += s.Weight
+				break
+			}
+		}
+	}
+	if total == 0 || earned == total {
+		return 0
+	}
+	return float64(earned) / float64(total)
+}
+
+const (
+	MetricCycles       = "cycles"
+	MetricInstructions = "instructions"
+	MetricTaskClock    = "task-clock" // milliseconds
+	MetricMaxRSS       = "max-rss"    // kilobytes
+
+	OutliersNone    = "none"    // mean of all repetitions
+	OutliersMedian  = "median"  // median of all repetitions
+	OutliersTrimmed = "trimmed" // mean without the fastest and the slowest repetitions
+)
+
+// PerfPolicy defines how the performance of a test is measured and scored
+// against the baseline. Zero values mean defaults.
+type PerfPolicy struct {
+	Metric      string  `json:"metric,omitempty"`
+	Threshold   float64 `json:"threshold,omitempty"` // max ratio to the baseline
+	Repetitions uint64  `json:"repetitions,omitempty"`
+	Outliers    string  `json:"outliers,omitempty"`
+	// Bonus is a fraction of the test score given for a ratio to the
+	// baseline of at most BonusThreshold.
+	Bonus          float64 `json:"bonus,omitempty"`
+	BonusThreshold float64 `json:"bonus_threshold,omitempty"`
+}
+
+// PerfPolicy returns the perf policy of the test with defaults filled in
+func (t *Test) PerfPolicy() PerfPolicy {
+	var p PerfPolicy
+	if t.Perf != nil {
+		p = *t.Perf
+	}
+	if p.Metric == "" {
+		p.Metric = MetricCycles
+	}
+	if p.Threshold == 0 {
+		p.Threshold = 1.2
+	}
+	if p.Repetitions == 0 {
+		p.Repetitions = 5
+	}
+	if p.Outliers == "" {
+		p.Outliers = OutliersNone
+	}
+	if p.BonusThreshold == 0 {
+		p.BonusThreshold = 1
+	}
+	return p
+}
+
+// Validate checks that the policy only refers to known metrics and methods
+func (p *PerfPolicy) Validate() error {
+	switch p.Metric {
+	case "", MetricCycles, MetricInstructions, MetricTaskClock, MetricMaxRSS:
+	default:
+		return fmt.Errorf("unknown perf metric: %s", p.Metric)
+	}
+	switch p.Outliers {
+	case "", OutliersNone, OutliersMedian, OutliersTrimmed:
+	default:
+		return fmt.Errorf("unknown outliers handling: %s", p.Outliers)
+	}
+	if p.Threshold < 0 || p.Bonus < 0 || p.BonusThreshold < 0 {
+		return fmt.Errorf("perf policy values cannot be negative")
+	}
+	return nil
+}
+
+// Limits are resource limits of a test container. Zero values mean defaults.
+type Limits struct {
+	Timeout uint64  `json:"timeout,omitempty"` // seconds
+	Memory  uint64  `json:"memory,omitempty"`  // megabytes
+	Cpus    float64 `json:"cpus,omitempty"`
+	Pids    uint64  `json:"pids,omitempty"`
 }
 
 type Stage struct {
-	Name   string   `json:"name"`
-	Status string   `json:"status"`
-	Test   string   `json:"test,omitempty"`
-	Output string   `json:"output,omitempty"`
-	Run    *RunHash `json:"run,omitempty"`
-	Cached bool     `json:"is_cached,omitempty"`
+	Name    string        `json:"name"`
+	Status  string        `json:"status"`
+	Test    string        `json:"test,omitempty"`
+	Output  string        `json:"output,omitempty"`
+	Results []*TestResult `json:"results,omitempty"`
+	Credit  float64       `json:"credit,omitempty"`
+	Run     *RunHash      `json:"run,omitempty"`
+	Cached  bool          `json:"is_cached,omitempty"`
+	LogKey  string        `json:"log_key,omitempty"` // full output if Output is truncated
+	LogURL  string        `json:"log_url,omitempty"`
+}
+
+// TestResult is an outcome of a single test or subtest of a test binary
+type TestResult struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"` // pass, fail or skip
+	Elapsed float64 `json:"elapsed"`
+	Output  string  `json:"output,omitempty"`
 }
 
 func (s *Stage) FillFromRun(stageName string, run *Run) {
@@ -28,6 +164,9 @@ func (s *Stage) FillFromRun(stageName string, run *Run) {
 	s.Status = run.Status
 	s.Test = run.Test
 	s.Output = run.Output
+	s.Results = run.Results
+	s.Credit = run.Credit
+	s.LogKey = run.LogKey
 }
 
 func (s *Stage) Success() bool {
@@ -35,37 +174,74 @@ func (s *Stage) Success() bool {
 }
 
 type Commit struct {
-	Login  string   `json:"login"`
-	Repo   string   `json:"repository"`
-	Commit string   `json:"commit"`
+	Login     string     `json:"login"`
+	Repo      string     `json:"repository"`
+	Commit    string     `json:"commit"`
+	Status    string     `json:"status"`
+	TaskID    string     `json:"task_id,omitempty"`
+	Submitted *time.Time `json:"submitted_at,omitempty"`
+	Checks    []*Stage   `json:"checks,omitempty"`
+}
+
+// Progress lists stages of a commit check reported by the runner so far,
+// starting from the given offset. Total is the offset of the next stage.
+type Progress struct {
 	Status string   `json:"status"`
-	Checks []*Stage `json:"checks"`
+	Stages []*Stage `json:"stages"`
+	Total  int      `json:"total"`
+}
+
+// RerunResult lists commits re-run in bulk as login:hash
+type RerunResult struct {
+	Commits []string `json:"commits"`
+	Failed  []string `json:"failed,omitempty"`
 }
 
 type Run struct {
-	Hash     string `json:"hash"`
-	Status   string `json:"status"`
-	Output   string `json:"output"`
-	Score    uint64 `json:"score"`
-	Test     string `json:"test"`
-	Baseline bool   `json:"baseline"`
+	Hash     string             `json:"hash"`
+	Status   string             `json:"status"`
+	Output   string             `json:"output"`
+	Results  []*TestResult      `json:"results,omitempty"`
+	Credit   float64            `json:"credit"`
+	Bonus    float64            `json:"-"`
+	Score    uint64             `json:"score"`
+	Metrics  map[string]float64 `json:"metrics,omitempty"`
+	Test     string             `json:"test"`
+	Baseline bool               `json:"baseline"`
+	LogKey   string             `json:"log_key,omitempty"` // full output if Output is truncated
 }
 
 type RunHash struct {
 	Hash string `json:"hash"`
 }
 
-func (r *Run) CompareToBaseline(b *Run) {
-	if r.Score == 0 {
+// CompareToBaseline scores the run by the ratio of its perf metric to the
+// baseline one. Runs are cached, so their scores may have been measured with
+// another metric; scores are only compared if either run lacks the metric.
+// Runs of tests without a baseline are left as they are.
+func (r *Run) CompareToBaseline(b *Run, p PerfPolicy) {
+	r.Bonus = 0
+	if b == nil {
 		return
 	}
-	percent := r.Score * 1000 / b.Score
-	humanPercent := float64(percent) / 10.
-	r.Output = fmt.Sprintf("Performance: %.1f%% of baseline", humanPercent)
-	if percent > 1200 {
+	value, ok := r.Metrics[p.Metric]
+	baseline, bok := b.Metrics[p.Metric]
+	if !ok || !bok {
+		value, baseline = float64(r.Score), float64(b.Score)
+	}
+	if value == 0 || baseline == 0 {
+		return
+	}
+	ratio := value / baseline
+	r.Output = fmt.Sprintf("Performance (%s): %.1f%% of baseline", p.Metric, ratio*100)
+	if ratio > p.Threshold {
 		r.Status = "failure"
-	} else {
-		r.Status = "success"
+		return
+	}
+	r.Status = "success"
+	if p.Bonus > 0 && ratio <= p.BonusThreshold {
+		r.Bonus = p.Bonus
+		r.Output += fmt.Sprintf(", bonus: %.0f%% of the test score", p.Bonus*100)
 	}
 }
 
@@ -92,21 +268,134 @@ func (t *Task) ReportSystemError(test string) {
 	})
 }
 
+// Queue is the state of the course queue. Status, Position (number of tasks
+// ahead) and ETA describe a single commit, if requested.
+type Queue struct {
+	Length    int        `json:"length"`
+	Executing int        `json:"executing"`
+	Runners   int        `json:"runners"`
+	Duration  float64    `json:"avg_duration"` // seconds
+	Status    string     `json:"status,omitempty"`
+	Position  *int       `json:"position,omitempty"`
+	ETA       *time.Time `json:"eta,omitempty"`
+}
+
+type Runner struct {
+	Id       string `json:"id"`
+	Hostname string `json:"hostname"`
+	Interval uint64 `json:"heartbeat_interval,omitempty"`
+}
+
 type Stat struct {
-	Login string `json:"login"`
-	Score uint   `json:"score"`
-	Count uint   `json:"count"`
+	Login string  `json:"login"`
+	Score float64 `json:"score"`
+	Count uint    `json:"count"`
+	// Stale is the number of scored tests graded by an older course version
+	Stale uint `json:"stale,omitempty"`
 }
 
 type UserStats struct {
-	Tests []*Test `json:"tests"`
-	Score uint64  `json:"score"`
-	Total uint64  `json:"total"`
+	Tests  []*Test  `json:"tests"`
+	Score  float64  `json:"score"`
+	Total  uint64   `json:"total"`
+	Stale  uint     `json:"stale,omitempty"`
+	Quotas []*Quota `json:"quotas,omitempty"`
+}
+
+// Quota limits the number of graded commits of a user per period. Used and
+// ResetAt describe the current usage by a user: ResetAt is set once the quota
+// is exhausted and tells when the next commit will be accepted.
+type Quota struct {
+	Limit   int           `json:"limit"`
+	Period  time.Duration `json:"period"`
+	Used    int           `json:"used"`
+	ResetAt *time.Time    `json:"reset_at,omitempty"`
+}
+
+// ParseQuota parses a quota in the N/period form, e.g. 10/1h or 50/24h
+func ParseQuota(v string) (*Quota, error) {
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid quota %q: expected N/period", v)
+	}
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("invalid quota %q: limit must be a positive number", v)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid quota %q: period must be a positive duration", v)
+	}
+	return &Quota{Limit: limit, Period: period}, nil
+}
+
+func (q *Quota) Remaining() int {
+	if q.Used >= q.Limit {
+		return 0
+	}
+	return q.Limit - q.Used
+}
+
+// Window describes the quota period in words, e.g. "hour" or "24 hours"
+func (q *Quota) Window() string {
+	switch {
+	case q.Period == time.Hour:
+		return "hour"
+	case q.Period == 24*time.Hour:
+		return "day"
+	case q.Period%time.Hour == 0:
+		return fmt.Sprintf("%d hours", q.Period/time.Hour)
+	case q.Period%time.Minute == 0:
+		return fmt.Sprintf("%d minutes", q.Period/time.Minute)
+	default:
+		return q.Period.String()
+	}
+}
+
+const (
+	LatePolicyReject     = "reject"
+	LatePolicyMultiplier = "multiplier"
+)
+
+// Deadline applies to a single test, to all tests of a topic or, if neither
+// is set, to the whole course.
+type Deadline struct {
+	Test       string    `json:"test,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+	Due        time.Time `json:"due_at"`
+	LatePolicy string    `json:"late_policy"`
+	Multiplier *float64  `json:"late_multiplier,omitempty"` // 1 if not set
+	Extended   bool      `json:"is_extended,omitempty"`
+}
+
+// LateNote explains to the student how a late submission has been graded
+func (d *Deadline) LateNote() string {
+	due := d.Due.UTC().Format("2006-01-02 15:04 MST")
+	if d.LatePolicy == LatePolicyMultiplier {
+		return fmt.Sprintf("Submitted after the deadline (%s), the score is multiplied by %g.", due, *d.Multiplier)
+	}
+	return fmt.Sprintf("Submitted after the deadline (%s), not graded.", due)
+}
+
+// Extension moves a deadline for a single user
+type Extension struct {
+	Login string    `json:"login"`
+	Test  string    `json:"test,omitempty"`
+	Topic string    `json:"topic,omitempty"`
+	Due   time.Time `json:"due_at"`
 }
 
 type Course struct {
-	Update time.Time `json:"updated_at,omitempty"`
-	Ready  bool      `json:"is_ready"`
+	Id       uint64    `json:"-"`
+	Name     string    `json:"name,omitempty"`
+	Template string    `json:"-"`
+	RepoName string    `json:"repository_name,omitempty"`
+	Update   time.Time `json:"updated_at,omitempty"`
+	Ready    bool      `json:"is_ready"`
+	Version  uint64    `json:"version,omitempty"`
+	// Regrade requests to re-run the latest graded commits if the course
+	// becomes ready with changed tests or baselines.
+	Regrade bool `json:"regrade,omitempty"`
 }
 
 type AppInstallData struct {
@@ -136,8 +425,44 @@ func (as *AuthStage) SetAuthCookie(w http.ResponseWriter) {
 	http.SetCookie(w, &cookie)
 }
 
+const (
+	RoleInstructor = "instructor"
+	RoleAssistant  = "assistant"
+)
+
 type User struct {
 	Id    uint64 `json:"id"`
 	Login string `json:"login"`
 	Repo  string `json:"repo"`
+	Role  string `json:"role,omitempty"`
+}
+
+// Student is an enrolled user as seen by the course staff
+type Student struct {
+	Login      string     `json:"login"`
+	Repo       string     `json:"repository"`
+	Role       string     `json:"role,omitempty"`
+	Commits    uint64     `json:"commits"`
+	LastCommit *time.Time `json:"last_commit_at,omitempty"`
+}
+
+// AuditEntry is an action of the course staff. Login is empty for actions
+// authenticated with the runner token.
+type AuditEntry struct {
+	Login   string          `json:"login,omitempty"`
+	Action  string          `json:"action"`
+	Target  string          `json:"target"`
+	Details json.RawMessage `json:"details,omitempty"`
+	Time    time.Time       `json:"created_at"`
+}
+
+// WebhookDelivery is a stored Github webhook and the outcome of its processing
+type WebhookDelivery struct {
+	DeliveryId  string     `json:"delivery_id"`
+	Event       string     `json:"event"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Attempts    int        `json:"attempts"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
 }
@@ -0,0 +1,118 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+func TestParseQuota(t *testing.T) {
+	cases := []struct {
+		v      string
+		limit  int
+		period time.Duration
+		window string
+	}{
+		{"10/1h", 10, time.Hour, "hour"},
+		{"50/24h", 50, 24 * time.Hour, "day"},
+		{"3/6h", 3, 6 * time.Hour, "6 hours"},
+		{"1/15m", 1, 15 * time.Minute, "15 minutes"},
+		{"2/90s", 2, 90 * time.Second, "1m30s"},
+	}
+	for _, c := range cases {
+		q, err := models.ParseQuota(c.v)
+		if err != nil {
+			t.Fatalf("%s: %v", c.v, err)
+		}
+		if q.Limit != c.limit || q.Period != c.period {
+			t.Errorf("%s: expected %d/%v, got %d/%v", c.v, c.limit, c.period, q.Limit, q.Period)
+		}
+		if w := q.Window(); w != c.window {
+			t.Errorf("%s: expected window %q, got %q", c.v, c.window, w)
+		}
+	}
+
+	for _, v := range []string{"", "10", "0/1h", "-1/1h", "x/1h", "10/", "10/0s", "10/-1h", "10/day"} {
+		if _, err := models.ParseQuota(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestCompareToBaseline(t *testing.T) {
+	policy := (&models.Test{Perf: &models.PerfPolicy{Bonus: 0.2, BonusThreshold: 0.8}}).PerfPolicy()
+	baseline := &models.Run{Score: 1000, Metrics: map[string]float64{models.MetricCycles: 2000}}
+
+	cases := []struct {
+		name     string
+		run      *models.Run
+		baseline *models.Run
+		status   string
+		bonus    float64
+	}{
+		{"no baseline", &models.Run{Status: "success", Score: 5000}, nil, "success", 0},
+		{"no score", &models.Run{Status: "success"}, baseline, "success", 0},
+		{"metric", &models.Run{Score: 9999, Metrics: map[string]float64{models.MetricCycles: 2200}}, baseline, "success", 0},
+		{"metric over threshold", &models.Run{Score: 1000, Metrics: map[string]float64{models.MetricCycles: 2500}}, baseline, "failure", 0},
+		{"metric at bonus threshold", &models.Run{Metrics: map[string]float64{models.MetricCycles: 1600}}, baseline, "success", 0.2},
+		{"missing metric", &models.Run{Score: 1300, Metrics: map[string]float64{models.MetricInstructions: 1}}, baseline, "failure", 0},
+		{"score fallback", &models.Run{Score: 1100}, &models.Run{Score: 1000}, "success", 0},
+		{"score fallback bonus", &models.Run{Score: 500}, &models.Run{Score: 1000}, "success", 0.2},
+		{"at threshold", &models.Run{Score: 1200}, &models.Run{Score: 1000}, "success", 0},
+		{"above bonus threshold", &models.Run{Score: 810}, &models.Run{Score: 1000}, "success", 0},
+		{"bonus reset", &models.Run{Score: 900, Bonus: 0.2}, &models.Run{Score: 1000}, "success", 0},
+	}
+	for _, c := range cases {
+		c.run.CompareToBaseline(c.baseline, policy)
+		if c.run.Status != c.status || c.run.Bonus != c.bonus {
+			t.Errorf("%s: expected %s with bonus %v, got %s with bonus %v", c.name, c.status, c.bonus, c.run.Status, c.run.Bonus)
+		}
+	}
+}
+
+func TestCompareToBaselineWithoutBonus(t *testing.T) {
+	policy := (&models.Test{}).PerfPolicy()
+	run := &models.Run{Score: 100}
+	run.CompareToBaseline(&models.Run{Score: 1000}, policy)
+	if run.Status != "success" || run.Bonus != 0 {
+		t.Errorf("expected success without bonus, got %s with bonus %v", run.Status, run.Bonus)
+	}
+}
+
+func TestCredit(t *testing.T) {
+	proportional := &models.Test{
+		Policy:   models.PolicyProportional,
+		Subtests: []*models.Subtest{{Name: "TestUnit/empty", Weight: 1}, {Name: "full", Weight: 3}},
+	}
+	results := func(statuses ...string) []*models.TestResult {
+		names := []string{"TestUnit/empty", "TestUnit/full"}
+		var rs []*models.TestResult
+		for i, s := range statuses {
+			rs = append(rs, &models.TestResult{Name: names[i], Status: s})
+		}
+		return rs
+	}
+
+	cases := []struct {
+		name   string
+		test   *models.Test
+		run    *models.Run
+		credit float64
+	}{
+		{"success", &models.Test{}, &models.Run{Status: "success"}, 1},
+		{"success with bonus", &models.Test{}, &models.Run{Status: "success", Bonus: 0.2}, 1.2},
+		{"all or nothing", &models.Test{}, &models.Run{Status: "failure", Results: results("pass", "fail")}, 0},
+		{"partial", proportional, &models.Run{Status: "failure", Results: results("pass", "fail")}, 0.25},
+		{"partial by last name", proportional, &models.Run{Status: "failure", Results: results("fail", "pass")}, 0.75},
+		{"none passed", proportional, &models.Run{Status: "failure", Results: results("fail", "fail")}, 0},
+		{"failure outside subtests", proportional, &models.Run{Status: "failure", Results: results("pass", "pass")}, 0},
+		{"no subtests", &models.Test{Policy: models.PolicyProportional}, &models.Run{Status: "failure"}, 0},
+		{"full", proportional, &models.Run{Status: "success", Results: results("pass", "pass")}, 1},
+	}
+	for _, c := range cases {
+		if credit := c.test.Credit(c.run); credit != c.credit {
+			t.Errorf("%s: expected %v, got %v", c.name, c.credit, credit)
+		}
+	}
+}
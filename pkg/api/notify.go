@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// notifier wakes up long-polling requests waiting for events, e.g. for
+// enqueued tasks of a course or for progress of a commit check.
+type notifier struct {
+	mu    sync.Mutex
+	chans map[uint64]chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{chans: map[uint64]chan struct{}{}}
+}
+
+// wait returns a channel that is closed on the next notification for the id
+func (n *notifier) wait(id uint64) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch, ok := n.chans[id]
+	if !ok {
+		ch = make(chan struct{})
+		n.chans[id] = ch
+	}
+	return ch
+}
+
+func (n *notifier) notify(id uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ch, ok := n.chans[id]; ok {
+		close(ch)
+		delete(n.chans, id)
+	}
+}
+
+// ListenTasks forwards Postgres notifications about enqueued tasks (the
+// payload is the course id) and about progress of tasks (the payload is the
+// commit id) to long-polling requests, reconnecting on errors.
+func (api *API) ListenTasks(ctx context.Context) {
+	for {
+		err := api.listenTasks(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[WARN] task notifications interrupted: %v", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (api *API) listenTasks(ctx context.Context) error {
+	conn, err := api.DB.Acquire(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not acquire connection")
+	}
+	defer releaseListener(conn)
+
+	for _, channel := range []string{"tasks", "progress"} {
+		if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		id, err := strconv.ParseUint(n.Payload, 10, 64)
+		if err != nil {
+			continue
+		}
+		switch n.Channel {
+		case "tasks":
+			api.tasks.notify(id)
+		case "progress":
+			api.progress.notify(id)
+		}
+	}
+}
+
+// releaseListener unsubscribes the connection before it is returned to the
+// pool, so that no one else inherits the subscriptions and pending
+// notifications. Connections that cannot be unsubscribed are closed and
+// dropped by the pool.
+func releaseListener(conn *pgxpool.Conn) {
+	defer conn.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := conn.Exec(ctx, "UNLISTEN *"); err != nil {
+		_ = conn.Conn().Close(ctx)
+	}
+}
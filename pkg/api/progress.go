@@ -0,0 +1,220 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/mkuznets/classbox/pkg/github"
+	"github.com/pkg/errors"
+)
+
+// ReportStages saves stages completed by the runner so far and updates the
+// Github check run with them. The final results are still submitted by
+// FinishTask.
+func (api *API) ReportStages(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	taskID := chi.URLParam(r, "taskID")
+	if _, err := uuid.Parse(taskID); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+
+	if err := api.checkLease(r.Context(), course.Id, taskID, r.Header.Get("X-Runner-ID")); err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	var stages []*models.Stage
+	if err := render.DecodeJSON(r.Body, &stages); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+	if len(stages) == 0 {
+		render.NoContent(w, r)
+		return
+	}
+
+	var prows [][]interface{}
+	for _, s := range stages {
+		prows = append(prows, []interface{}{taskID, s.Name, s.Status, s.Output, s.Results, s.Cached})
+	}
+	cols := []string{"task_id", "name", "status", "output", "results", "is_cached"}
+	_, err := api.DB.CopyFrom(r.Context(), pgx.Identifier{"progress"}, cols, pgx.CopyFromRows(prows))
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	if err := api.updateProgress(r.Context(), course.Name, taskID); err != nil {
+		log.Printf("[WARN] task %s: could not update check run: %v", taskID, err)
+	}
+
+	render.NoContent(w, r)
+}
+
+// updateProgress shows the stages reported so far in the Github check run
+func (api *API) updateProgress(ctx context.Context, courseName, taskID string) error {
+	var (
+		login, repo, commitHash string
+		instID                  int
+		checkRunID              uint64
+	)
+	err := api.DB.QueryRow(ctx, `
+	SELECT u.login, e.repository_name, c.commit, u.installation_id, c.check_run_id
+	FROM tasks AS t
+		JOIN commits AS c ON (c.id=t.commit_id)
+		JOIN users AS u ON (u.id=c.user_id)
+		JOIN enrollments AS e ON (e.user_id=u.id AND e.course_id=c.course_id)
+	WHERE t.id=$1 AND u.installation_id IS NOT NULL LIMIT 1
+	`, taskID).Scan(&login, &repo, &commitHash, &instID, &checkRunID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	rows, err := api.DB.Query(ctx, `
+	SELECT name, status::text, output, results, is_cached FROM progress WHERE task_id=$1 ORDER BY id
+	`, taskID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var stages []*models.Stage
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		s := models.Stage{}
+		if err := rows.Scan(&s.Name, &s.Status, &s.Output, &s.Results, &s.Cached); err != nil {
+			return errors.WithStack(err)
+		}
+		stages = append(stages, &s)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	summary, err := api.checkRunSummary(courseName, login, commitHash, stages)
+	if err != nil {
+		return err
+	}
+
+	gh, err := api.installation(ctx, instID)
+	if err != nil {
+		return err
+	}
+	return gh.UpdateCheckRun(ctx, login, repo, &github.CheckRun{
+		ID:     checkRunID,
+		Status: "in_progress",
+		Output: &github.CheckRunOutput{
+			Title:   fmt.Sprintf("Running: %d checks completed", len(stages)),
+			Summary: summary,
+		},
+	})
+}
+
+// GetProgress returns stages of the commit check reported after the first
+// ?after=... ones. With ?wait=... the request waits for new stages or for the
+// task status to change.
+func (api *API) GetProgress(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	commitHash := chi.URLParam(r, "commitHash")
+	login := chi.URLParam(r, "login")
+
+	var after int
+	if v := r.URL.Query().Get("after"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			E.SendError(w, r, err, http.StatusBadRequest, "invalid offset")
+			return
+		}
+		after = n
+	}
+	wait, err := parseWait(r)
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+	timeout := time.After(wait)
+
+	var commitID uint64
+	err = api.DB.QueryRow(r.Context(), `
+	SELECT c.id FROM commits AS c JOIN users AS u ON (u.id=c.user_id)
+	WHERE c.commit=$1 AND u.login=$2 AND c.course_id=$3
+	LIMIT 1
+	`, commitHash, login, course.Id).Scan(&commitID)
+	switch {
+	case err == pgx.ErrNoRows:
+		e := fmt.Errorf("unknown commit: %s:%s", login, commitHash)
+		E.SendError(w, r, e, http.StatusNotFound, e.Error())
+		return
+	case err != nil:
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	for {
+		notified := api.progress.wait(commitID)
+
+		p, err := api.commitProgress(r.Context(), commitID, after)
+		if err != nil {
+			E.Handle(w, r, err)
+			return
+		}
+		active := p.Status == "ENQUEUED" || p.Status == "EXECUTING"
+		if len(p.Stages) == 0 && active && wait > 0 {
+			select {
+			case <-notified:
+				continue
+			case <-time.After(pollInterval):
+				continue
+			case <-timeout:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		render.JSON(w, r, p)
+		return
+	}
+}
+
+func (api *API) commitProgress(ctx context.Context, commitID uint64, after int) (*models.Progress, error) {
+	p := &models.Progress{Stages: make([]*models.Stage, 0), Total: after}
+
+	var taskID string
+	err := api.DB.QueryRow(ctx, `
+	SELECT id::text, UPPER(status::text) FROM tasks WHERE commit_id=$1
+	`, commitID).Scan(&taskID, &p.Status)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rows, err := api.DB.Query(ctx, `
+	SELECT name, UPPER(status::text), output, results FROM progress WHERE task_id=$1 ORDER BY id OFFSET $2
+	`, taskID, after)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		s := models.Stage{}
+		if err := rows.Scan(&s.Name, &s.Status, &s.Output, &s.Results); err != nil {
+			return errors.WithStack(err)
+		}
+		p.Stages = append(p.Stages, &s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.Total += len(p.Stages)
+	return p, nil
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/jackc/pgx/v4"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	// etaSamples is the number of recently finished tasks the ETA is based on
+	etaSamples = 50
+	// defaultDuration is the task duration assumed when there is no history
+	defaultDuration = time.Minute
+)
+
+// GetQueue reports the state of the course queue. The position and ETA are
+// given for a commit (?login=...&commit=...) or, if there is none, for the
+// earliest enqueued commit of the authenticated user.
+func (api *API) GetQueue(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	queue := models.Queue{}
+	err := api.DB.QueryRow(r.Context(), `
+	SELECT
+		COUNT(*) FILTER (WHERE t.status='enqueued'),
+		COUNT(*) FILTER (WHERE t.status='executing'),
+		(SELECT COUNT(*) FROM runners WHERE course_id=$1 AND heartbeat_at > STATEMENT_TIMESTAMP() - $2 * interval '1 second'),
+		(SELECT COALESCE(EXTRACT(EPOCH FROM AVG(d.finished_at - d.started_at))::float8, 0) FROM (
+			SELECT ft.started_at, ft.finished_at
+			FROM tasks AS ft JOIN commits AS fc ON (fc.id=ft.commit_id)
+			WHERE fc.course_id=$1 AND ft.status='finished' AND ft.started_at IS NOT NULL
+			ORDER BY ft.finished_at DESC LIMIT $3
+		) AS d)
+	FROM tasks AS t JOIN commits AS c ON (c.id=t.commit_id)
+	WHERE c.course_id=$1 AND t.status IN ('enqueued', 'executing')
+	`, course.Id, api.TaskLease.Seconds(), etaSamples).Scan(&queue.Length, &queue.Executing, &queue.Runners, &queue.Duration)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+	if queue.Duration == 0 {
+		queue.Duration = defaultDuration.Seconds()
+	}
+
+	login, commitHash := r.URL.Query().Get("login"), r.URL.Query().Get("commit")
+	if user, ok := r.Context().Value("User").(*models.User); ok && login == "" {
+		login = user.Login
+	}
+	if login != "" {
+		if err := api.queuePosition(r.Context(), course.Id, login, commitHash, &queue); err != nil {
+			E.Handle(w, r, err)
+			return
+		}
+	}
+
+	render.JSON(w, r, &queue)
+}
+
+// queuePosition fills the position and ETA of a commit in the queue. The
+// position is approximate: tasks ahead are counted by priority and enqueue
+// time, regardless of the round-robin between users.
+func (api *API) queuePosition(ctx context.Context, courseID uint64, login, commitHash string, q *models.Queue) error {
+	var (
+		status    string
+		startedAt *time.Time
+		ahead     int
+	)
+	err := api.DB.QueryRow(ctx, `
+	SELECT UPPER(t.status::text), t.started_at, (
+		SELECT COUNT(*) FROM tasks AS ot JOIN commits AS oc ON (oc.id=ot.commit_id)
+		WHERE oc.course_id=c.course_id AND ot.status='enqueued' AND ot.id<>t.id
+			AND (ot.priority > t.priority OR (ot.priority=t.priority AND ot.enqueued_at < t.enqueued_at))
+	)
+	FROM tasks AS t
+		JOIN commits AS c ON (c.id=t.commit_id)
+		JOIN users AS u ON (u.id=c.user_id)
+	WHERE c.course_id=$1 AND u.login=$2 AND ($3='' OR c.commit=$3)
+		AND t.status IN ('enqueued', 'executing')
+	ORDER BY t.priority DESC, t.enqueued_at
+	LIMIT 1
+	`, courseID, login, commitHash).Scan(&status, &startedAt, &ahead)
+	switch {
+	case err == pgx.ErrNoRows:
+		return nil
+	case err != nil:
+		return errors.WithStack(err)
+	}
+
+	duration := time.Duration(q.Duration * float64(time.Second))
+	q.Status = status
+	var eta time.Time
+	if status == "EXECUTING" && startedAt != nil {
+		eta = startedAt.Add(duration)
+	} else {
+		runners := q.Runners
+		if runners == 0 {
+			runners = 1
+		}
+		q.Position = &ahead
+		eta = time.Now().Add(time.Duration(ahead/runners+1) * duration)
+	}
+	if eta.Before(time.Now()) {
+		eta = time.Now()
+	}
+	q.ETA = &eta
+	return nil
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/pkg/errors"
+)
+
+// quotaUsage returns the configured quotas filled with the usage by the user
+// at the given time. Skipped commits are not counted.
+func (api *API) quotaUsage(ctx context.Context, courseID, userID uint64, at time.Time) ([]*models.Quota, error) {
+	usage := make([]*models.Quota, 0, len(api.Quotas))
+	if len(api.Quotas) == 0 {
+		return usage, nil
+	}
+
+	var longest time.Duration
+	for _, q := range api.Quotas {
+		if q.Period > longest {
+			longest = q.Period
+		}
+	}
+	rows, err := api.DB.Query(ctx, `
+	SELECT c.submitted_at
+	FROM commits AS c JOIN tasks AS t ON (t.commit_id=c.id)
+	WHERE c.user_id=$1 AND c.course_id=$2 AND c.submitted_at > $3 AND t.status<>'skipped'
+	ORDER BY c.submitted_at DESC
+	`, userID, courseID, at.Add(-longest))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var submitted []time.Time
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return errors.WithStack(err)
+		}
+		submitted = append(submitted, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, q := range api.Quotas {
+		usage = append(usage, quotaWindow(q, submitted, at))
+	}
+	return usage, nil
+}
+
+// quotaWindow fills the quota with the number of commits submitted within its
+// period before the given time. Submission times are sorted from the latest.
+// An exhausted quota frees up once the Limit-th latest commit leaves the
+// period.
+func quotaWindow(q *models.Quota, submitted []time.Time, at time.Time) *models.Quota {
+	u := &models.Quota{Limit: q.Limit, Period: q.Period}
+	since := at.Add(-q.Period)
+	for _, t := range submitted {
+		if !t.After(since) {
+			break
+		}
+		u.Used++
+		if u.Used == u.Limit {
+			resetAt := t.Add(q.Period)
+			u.ResetAt = &resetAt
+		}
+	}
+	return u
+}
+
+// quotaExceeded returns the time when the user will be able to submit again,
+// or nil if no quota is exhausted.
+func quotaExceeded(usage []*models.Quota) *time.Time {
+	var retryAt *time.Time
+	for _, q := range usage {
+		if q.ResetAt != nil && (retryAt == nil || q.ResetAt.After(*retryAt)) {
+			retryAt = q.ResetAt
+		}
+	}
+	return retryAt
+}
+
+// quotaSummary explains to the student why a commit has not been graded
+func quotaSummary(usage []*models.Quota) string {
+	var b strings.Builder
+	b.WriteString("This commit exceeds the limit of graded commits and will not be graded:\n\n")
+	for _, q := range usage {
+		if q.ResetAt == nil {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("* %d commits per %s, next commit is accepted at %s\n",
+			q.Limit, q.Window(), q.ResetAt.UTC().Format("15:04 MST")))
+	}
+	b.WriteString("\nAfter that time, push again or re-run the checks of this commit on GitHub.\n")
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+func TestQuotaWindow(t *testing.T) {
+	at := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	submitted := []time.Time{
+		at.Add(-10 * time.Minute),
+		at.Add(-30 * time.Minute),
+		at.Add(-50 * time.Minute),
+		at.Add(-2 * time.Hour),
+	}
+
+	cases := []struct {
+		quota   models.Quota
+		used    int
+		resetAt *time.Time
+	}{
+		{models.Quota{Limit: 5, Period: time.Hour}, 3, nil},
+		{models.Quota{Limit: 3, Period: time.Hour}, 3, timePtr(at.Add(10 * time.Minute))},
+		{models.Quota{Limit: 2, Period: time.Hour}, 3, timePtr(at.Add(30 * time.Minute))},
+		{models.Quota{Limit: 4, Period: 24 * time.Hour}, 4, timePtr(at.Add(22 * time.Hour))},
+		{models.Quota{Limit: 1, Period: 5 * time.Minute}, 0, nil},
+	}
+	for _, c := range cases {
+		u := quotaWindow(&c.quota, submitted, at)
+		if u.Used != c.used {
+			t.Errorf("%d/%v: expected %d used, got %d", c.quota.Limit, c.quota.Period, c.used, u.Used)
+		}
+		switch {
+		case c.resetAt == nil && u.ResetAt != nil:
+			t.Errorf("%d/%v: expected no reset, got %v", c.quota.Limit, c.quota.Period, u.ResetAt)
+		case c.resetAt != nil && (u.ResetAt == nil || !u.ResetAt.Equal(*c.resetAt)):
+			t.Errorf("%d/%v: expected reset at %v, got %v", c.quota.Limit, c.quota.Period, c.resetAt, u.ResetAt)
+		}
+	}
+
+	if retryAt := quotaExceeded(nil); retryAt != nil {
+		t.Errorf("expected no limit without quotas, got %v", retryAt)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/jackc/pgx/v4"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/mkuznets/classbox/pkg/github"
+	"github.com/pkg/errors"
+)
+
+// rerunWindow is the period over which re-runs requested by a user are limited
+const rerunWindow = time.Hour
+
+// rerunTarget is a commit to be re-run together with its repository
+type rerunTarget struct {
+	commitID   uint64
+	commitHash string
+	userID     uint64
+	login      string
+	repoName   string
+	instID     *int
+}
+
+// RerunCommit runs the tests of a commit again under a new check run. Owners
+// of commits are limited to RerunLimit re-runs per hour, the course staff can
+// re-run any commit.
+func (api *API) RerunCommit(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	commitHash := chi.URLParam(r, "commitHash")
+	login := chi.URLParam(r, "login")
+
+	session := r.Header.Get("X-Session")
+	if session == "" {
+		E.SendError(w, r, nil, http.StatusUnauthorized, "user not authenticated")
+		return
+	}
+	staff, err := staffUser(r.Context(), api.DB, session, course.Id)
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+	user, _ := r.Context().Value("User").(*models.User)
+	if staff == nil && (user == nil || user.Login != login) {
+		E.SendError(w, r, nil, http.StatusForbidden, "only the owner of the commit can re-run it")
+		return
+	}
+
+	t, err := api.getRerunTarget(r.Context(), course.Id, login, commitHash)
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	ctx, limited := r.Context(), true
+	if staff != nil {
+		ctx, limited = context.WithValue(ctx, "User", staff), false
+	}
+
+	if err := api.rerunCommit(ctx, course, t, priorityInteractive, limited); err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// EnqueueCommit runs the tests of a commit again under a new check run on
+// behalf of the course staff, whatever the state of its task.
+func (api *API) EnqueueCommit(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	t, err := api.getRerunTarget(r.Context(), course.Id, chi.URLParam(r, "login"), chi.URLParam(r, "commitHash"))
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+	if err := api.rerunCommit(r.Context(), course, t, priorityInteractive, false); err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// RerunExceptions re-runs all commits with exception checks finished since the
+// given time, e.g. after a runner bug has been fixed.
+func (api *API) RerunExceptions(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	var req struct {
+		Since time.Time `json:"since"`
+	}
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+
+	rows, err := api.DB.Query(r.Context(), `
+	SELECT c.id, c.commit, u.id, u.login, e.repository_name, u.installation_id
+	FROM commits AS c
+		JOIN tasks AS t ON (t.commit_id=c.id)
+		JOIN users AS u ON (u.id=c.user_id)
+		JOIN enrollments AS e ON (e.user_id=u.id AND e.course_id=c.course_id)
+	WHERE c.course_id=$1 AND t.status='finished' AND t.finished_at >= $2
+		AND EXISTS (SELECT 1 FROM checks AS ch WHERE ch.commit_id=c.id AND ch.status='exception')
+	ORDER BY c.id
+	`, course.Id, req.Since)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+
+	var targets []*rerunTarget
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		t := rerunTarget{}
+		if err := rows.Scan(&t.commitID, &t.commitHash, &t.userID, &t.login, &t.repoName, &t.instID); err != nil {
+			return errors.WithStack(err)
+		}
+		targets = append(targets, &t)
+		return nil
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	result := &models.RerunResult{Commits: make([]string, 0)}
+	for _, t := range targets {
+		ref := fmt.Sprintf("%s:%s", t.login, t.commitHash)
+		if err := api.rerunCommit(r.Context(), course, t, priorityBulk, false); err != nil {
+			log.Printf("[ERR] could not re-run %s: %v", ref, err)
+			result.Failed = append(result.Failed, ref)
+			continue
+		}
+		result.Commits = append(result.Commits, ref)
+	}
+
+	render.JSON(w, r, result)
+}
+
+func (api *API) getRerunTarget(ctx context.Context, courseID uint64, login, commitHash string) (*rerunTarget, error) {
+	t := rerunTarget{}
+	err := api.DB.QueryRow(ctx, `
+	SELECT c.id, c.commit, u.id, u.login, e.repository_name, u.installation_id
+	FROM commits AS c
+		JOIN tasks AS t ON (t.commit_id=c.id)
+		JOIN users AS u ON (u.id=c.user_id)
+		JOIN enrollments AS e ON (e.user_id=u.id AND e.course_id=c.course_id)
+	WHERE c.commit=$1 AND u.login=$2 AND c.course_id=$3
+	LIMIT 1
+	`, commitHash, login, courseID).Scan(&t.commitID, &t.commitHash, &t.userID, &t.login, &t.repoName, &t.instID)
+	switch {
+	case err == pgx.ErrNoRows:
+		e := fmt.Errorf("unknown commit: %s:%s", login, commitHash)
+		return nil, E.New(e, http.StatusNotFound, e.Error())
+	case err != nil:
+		return nil, errors.WithStack(err)
+	}
+	return &t, nil
+}
+
+// rerunCommit creates a new check run for the commit and enqueues it the same
+// way as the check_suite webhook does. The re-run is attributed to the user
+// from the context. Limited re-runs are requested by owners of commits and
+// are subject to RerunLimit, others are done by the course staff and are
+// recorded in the audit log. The check run is created outside of
+// transactions, so that the lock on the user is not held while Github
+// responds.
+func (api *API) rerunCommit(ctx context.Context, course *models.Course, t *rerunTarget, priority int, limited bool) error {
+	if t.instID == nil {
+		return E.New(nil, http.StatusConflict, "the app is not installed by the user")
+	}
+	user, _ := ctx.Value("User").(*models.User)
+
+	gh, err := api.installation(ctx, *t.instID)
+	if err != nil {
+		return err
+	}
+
+	if user != nil {
+		err := db.Tx(ctx, api.DB, func(tx pgx.Tx) error {
+			if limited {
+				if err := api.checkRerunLimit(ctx, tx, t, user); err != nil {
+					return err
+				}
+			}
+			return recordRerun(ctx, tx, t.commitID, user)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	checkRun, err := gh.CreateCheckRun(ctx, t.login, t.repoName, api.queuedCheckRun(course.Name, t.login, t.commitHash))
+	if err != nil {
+		return errors.Wrap(err, "could not create a check run")
+	}
+
+	err = db.Tx(ctx, api.DB, func(tx pgx.Tx) error {
+		if _, err := enqueueCommit(ctx, tx, t.userID, course.Id, t.commitHash, checkRun.ID, priority, originRerun); err != nil {
+			return err
+		}
+		if !limited {
+			return audit(ctx, tx, course.Id, "rerun_commit", t.login+":"+t.commitHash, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		// The check run is not left queued without a task
+		uerr := gh.UpdateCheckRun(ctx, t.login, t.repoName, &github.CheckRun{
+			ID:             checkRun.ID,
+			Status:         "completed",
+			Conclusion:     "cancelled",
+			CompletionTime: time.Now().UTC().Format(time.RFC3339),
+			Output: &github.CheckRunOutput{
+				Title:   "Cancelled: the re-run could not be enqueued",
+				Summary: "Please try again later.",
+			},
+		})
+		if uerr != nil {
+			log.Printf("[ERR] could not cancel check run of %s:%s: %v", t.login, t.commitHash, uerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkRerunLimit allows the user to re-run the finished commit if they have
+// not exceeded RerunLimit. Concurrent re-runs of the user wait for the
+// transaction holding the lock on the user.
+func (api *API) checkRerunLimit(ctx context.Context, tx pgx.Tx, t *rerunTarget, user *models.User) error {
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE id=$1 FOR UPDATE`, user.Id); err != nil {
+		return errors.WithStack(err)
+	}
+
+	var finished bool
+	err := tx.QueryRow(ctx, `
+	SELECT status IN ('finished', 'skipped') FROM tasks WHERE commit_id=$1
+	`, t.commitID).Scan(&finished)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !finished {
+		return E.New(nil, http.StatusConflict, "the commit is being checked")
+	}
+
+	var count int
+	err = tx.QueryRow(ctx, `
+	SELECT COUNT(*) FROM reruns WHERE user_id=$1 AND requested_at > STATEMENT_TIMESTAMP() - $2 * interval '1 second'
+	`, user.Id, rerunWindow.Seconds()).Scan(&count)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if count >= api.RerunLimit {
+		e := fmt.Errorf("re-run limit exceeded: at most %d re-runs per hour", api.RerunLimit)
+		return E.New(e, http.StatusTooManyRequests, e.Error())
+	}
+	return nil
+}
+
+// recordRerun saves the re-run of the commit requested by the user, it counts
+// against RerunLimit of the user
+func recordRerun(ctx context.Context, tx pgx.Tx, commitID uint64, user *models.User) error {
+	_, err := tx.Exec(ctx, `INSERT INTO reruns (commit_id, user_id) VALUES ($1, $2)`, commitID, user.Id)
+	return errors.WithStack(err)
+}
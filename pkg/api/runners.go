@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	E "github.com/mkuznets/classbox/pkg/api/errors"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/db"
+	"github.com/pkg/errors"
+)
+
+const reapInterval = 30 * time.Second
+
+// RegisterRunner registers the runner on the first call and records a heartbeat
+// on subsequent ones, extending leases of the tasks the runner is executing.
+func (api *API) RegisterRunner(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	runnerID := chi.URLParam(r, "runnerID")
+	if _, err := uuid.Parse(runnerID); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+
+	var runner models.Runner
+	if err := render.DecodeJSON(r.Body, &runner); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+
+	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+		_, err := tx.Exec(r.Context(), `
+		INSERT INTO runners (id, course_id, hostname) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE
+		SET hostname=EXCLUDED.hostname, heartbeat_at=STATEMENT_TIMESTAMP()
+		`, runnerID, course.Id, runner.Hostname)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = tx.Exec(r.Context(), `
+		UPDATE tasks SET lease_expires_at=STATEMENT_TIMESTAMP() + $2 * interval '1 second'
+		WHERE runner_id=$1 AND status='executing'
+		`, runnerID, api.TaskLease.Seconds())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	})
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	runner.Id = runnerID
+	runner.Interval = uint64(api.TaskLease.Seconds() / 3)
+	if runner.Interval == 0 {
+		runner.Interval = 1
+	}
+	render.JSON(w, r, &runner)
+}
+
+// ReapTasks periodically re-enqueues tasks whose runners stopped sending
+// heartbeats. Tasks that have exceeded the retry limit are finished with
+// a system error.
+func (api *API) ReapTasks(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		if err := api.reapTasks(ctx); err != nil {
+			log.Printf("[ERR] could not reap tasks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (api *API) reapTasks(ctx context.Context) error {
+	rows, err := api.DB.Query(ctx, `
+	UPDATE tasks SET status='enqueued', runner_id=NULL, lease_expires_at=NULL, retries=retries+1
+	WHERE status='executing' AND lease_expires_at < STATEMENT_TIMESTAMP() AND retries < $1
+	RETURNING id, retries
+	`, api.TaskRetries)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		var (
+			taskID  string
+			retries int
+		)
+		if err := rows.Scan(&taskID, &retries); err != nil {
+			return errors.WithStack(err)
+		}
+		log.Printf("[WARN] task %s: lease expired, re-enqueued (retry %d of %d)", taskID, retries, api.TaskRetries)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err = api.DB.Query(ctx, `
+	SELECT id FROM tasks
+	WHERE status='executing' AND lease_expires_at < STATEMENT_TIMESTAMP() AND retries >= $1
+	`, api.TaskRetries)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var expired []string
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		var taskID string
+		if err := rows.Scan(&taskID); err != nil {
+			return errors.WithStack(err)
+		}
+		expired = append(expired, taskID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, taskID := range expired {
+		stages := []*models.Stage{{
+			Name:   "system",
+			Status: "exception",
+			Output: "Runner stopped responding while executing the tests. Reported to administrators.",
+		}}
+		if err := api.completeTask(ctx, taskID, stages); err != nil {
+			log.Printf("[ERR] task %s: could not finish expired task: %v", taskID, err)
+			continue
+		}
+		log.Printf("[WARN] task %s: lease expired, retry limit exceeded", taskID)
+	}
+
+	return nil
+}
@@ -15,17 +15,18 @@ import (
 )
 
 func (api *API) GetRuns(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	hashes := &pgtype.TextArray{}
 	_ = hashes.Set(r.URL.Query()["hash"])
 
 	sql := fmt.Sprintf(`
-	SELECT r.hash, r.status, r.output, r.score, t.name, r.is_baseline
+	SELECT r.hash, r.status, r.output, r.results, r.credit, r.score, r.metrics, t.name, r.is_baseline, COALESCE(r.log_key, '')
 	FROM runs as r JOIN tests as t ON (t.id=r.test_id)
-	WHERE r.hash=ANY($1) AND t.is_deleted='f'
+	WHERE r.hash=ANY($1) AND t.course_id=$2 AND t.is_deleted='f'
 	`)
 
-	rows, err := api.DB.Query(r.Context(), sql, hashes)
+	rows, err := api.DB.Query(r.Context(), sql, hashes, course.Id)
 	if err != nil {
 		E.Handle(w, r, err)
 		return
@@ -35,7 +36,7 @@ func (api *API) GetRuns(w http.ResponseWriter, r *http.Request) {
 
 	err = db.IterRows(rows, func(rows pgx.Rows) error {
 		run := models.Run{}
-		if err := rows.Scan(&run.Hash, &run.Status, &run.Output, &run.Score, &run.Test, &run.Baseline); err != nil {
+		if err := rows.Scan(&run.Hash, &run.Status, &run.Output, &run.Results, &run.Credit, &run.Score, &run.Metrics, &run.Test, &run.Baseline, &run.LogKey); err != nil {
 			return errors.WithStack(err)
 		}
 		runs = append(runs, &run)
@@ -50,6 +51,7 @@ func (api *API) GetRuns(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) CreateRuns(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	var runs []models.Run
 	if err := render.DecodeJSON(r.Body, &runs); err != nil {
@@ -58,7 +60,7 @@ func (api *API) CreateRuns(w http.ResponseWriter, r *http.Request) {
 	}
 
 	testNames := utils.UniqueStringFields(runs, "Test")
-	testIds, err := api.getTestIds(r.Context(), testNames)
+	testIds, err := api.getTestIds(r.Context(), course.Id, testNames)
 	if err != nil {
 		E.Handle(w, r, err)
 		return
@@ -71,11 +73,11 @@ func (api *API) CreateRuns(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			_, err := tx.Exec(r.Context(), `
-			INSERT INTO runs ("hash", status, output, score, test_id, is_baseline)
-			VALUES ($1, $2, $3, $4, $5, $6)
+			INSERT INTO runs ("hash", status, output, results, credit, score, metrics, test_id, is_baseline, log_key)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''))
 			ON CONFLICT ("hash") DO UPDATE
 			SET is_baseline=EXCLUDED.is_baseline
-			`, run.Hash, run.Status, run.Output, run.Score, testID, run.Baseline)
+			`, run.Hash, run.Status, run.Output, run.Results, run.Credit, run.Score, run.Metrics, testID, run.Baseline, run.LogKey)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -91,6 +93,7 @@ func (api *API) CreateRuns(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) GetBaselines(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	testNames := r.URL.Query()["test"]
 
@@ -98,13 +101,13 @@ func (api *API) GetBaselines(w http.ResponseWriter, r *http.Request) {
 	_ = tests.Set(testNames)
 
 	sql := fmt.Sprintf(`
-	SELECT DISTINCT ON (t.id) r.hash, r.status, r.output, r.score, t.name, r.is_baseline
+	SELECT DISTINCT ON (t.id) r.hash, r.status, r.output, r.results, r.credit, r.score, r.metrics, t.name, r.is_baseline, COALESCE(r.log_key, '')
 	FROM runs AS r JOIN tests as t ON (t.id=r.test_id)
-	WHERE r.is_baseline='t' AND r.status='success' AND t.name=ANY($1) AND t.is_deleted='f'
+	WHERE r.is_baseline='t' AND r.status='success' AND t.name=ANY($1) AND t.course_id=$2 AND t.is_deleted='f'
 	ORDER BY t.id, r.id DESC
 	`)
 
-	rows, err := api.DB.Query(r.Context(), sql, tests)
+	rows, err := api.DB.Query(r.Context(), sql, tests, course.Id)
 	if err != nil {
 		E.Handle(w, r, err)
 		return
@@ -119,7 +122,7 @@ func (api *API) GetBaselines(w http.ResponseWriter, r *http.Request) {
 
 	err = db.IterRows(rows, func(rows pgx.Rows) error {
 		run := models.Run{}
-		if err := rows.Scan(&run.Hash, &run.Status, &run.Output, &run.Score, &run.Test, &run.Baseline); err != nil {
+		if err := rows.Scan(&run.Hash, &run.Status, &run.Output, &run.Results, &run.Credit, &run.Score, &run.Metrics, &run.Test, &run.Baseline, &run.LogKey); err != nil {
 			return errors.WithStack(err)
 		}
 		runs = append(runs, &run)
@@ -17,14 +17,20 @@ import (
 	"github.com/pkg/errors"
 )
 
-const repoName = "hsecode-stdlib"
+// oauthState binds the random state to the course, so that the web app can
+// route Github callbacks back to the course the user signed in to.
+func (api *API) oauthState(course *models.Course) string {
+	return fmt.Sprintf("%s.%s", course.Name, api.RandomState)
+}
 
 func (api *API) AppURL(w http.ResponseWriter, r *http.Request) {
-	render.JSON(w, r, map[string]string{"url": api.App.Config().AuthCodeURL(api.RandomState)})
+	course := r.Context().Value("Course").(*models.Course)
+	render.JSON(w, r, map[string]string{"url": api.App.Config().AuthCodeURL(api.oauthState(course))})
 }
 
 func (api *API) OAuthURL(w http.ResponseWriter, r *http.Request) {
-	render.JSON(w, r, map[string]string{"url": api.OAuth.Config().AuthCodeURL(api.RandomState)})
+	course := r.Context().Value("Course").(*models.Course)
+	render.JSON(w, r, map[string]string{"url": api.OAuth.Config().AuthCodeURL(api.oauthState(course))})
 }
 
 type oauthData struct {
@@ -33,6 +39,7 @@ type oauthData struct {
 }
 
 func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	data := oauthData{}
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -41,7 +48,7 @@ func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if api.RandomState != data.State {
+	if api.oauthState(course) != data.State {
 		E.SendError(w, r, nil, http.StatusBadRequest, "invalid state")
 		return
 	}
@@ -53,7 +60,7 @@ func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	redirectToOAuth := func() {
-		render.JSON(w, r, models.AuthStage{Url: api.OAuth.Config().AuthCodeURL(api.RandomState)})
+		render.JSON(w, r, models.AuthStage{Url: api.OAuth.Config().AuthCodeURL(api.oauthState(course))})
 	}
 
 	gh := github.New(token)
@@ -64,7 +71,7 @@ func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repo, err := gh.Repo(r.Context(), user.Login, repoName)
+	repo, err := gh.Repo(r.Context(), user.Login, course.RepoName)
 	if err != nil {
 		if e, ok := err.(*github.ErrorResponse); ok && e.NotFound() {
 			redirectToOAuth()
@@ -81,10 +88,10 @@ func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
 			installationId *uint64
 		)
 		err := tx.QueryRow(r.Context(), `
-		UPDATE "users" SET login=$2, email=$3, repository_id=$4, repository_name=$5
+		UPDATE "users" SET login=$2, email=$3
 		WHERE "github_id"=$1
 		RETURNING id, installation_id
-		`, user.ID, user.Login, user.Email, repo.ID, repo.Name).Scan(&userId, &installationId)
+		`, user.ID, user.Login, user.Email).Scan(&userId, &installationId)
 		switch {
 		case err == pgx.ErrNoRows:
 			redirectToOAuth()
@@ -92,6 +99,9 @@ func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
 		case err != nil:
 			return errors.WithStack(err)
 		}
+		if err := enroll(r.Context(), tx, userId, course.Id, repo); err != nil {
+			return errors.WithStack(err)
+		}
 
 		found := false
 		if installationId != nil {
@@ -113,7 +123,7 @@ func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		render.JSON(w, r, &models.AuthStage{Session: session, Url: api.WebUrl})
+		render.JSON(w, r, &models.AuthStage{Session: session, Url: fmt.Sprintf("%s/%s", api.WebUrl, course.Name)})
 		return nil
 	})
 	if err != nil {
@@ -123,6 +133,7 @@ func (api *API) Signin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	data := oauthData{}
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -131,7 +142,7 @@ func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if api.RandomState != data.State {
+	if api.oauthState(course) != data.State {
 		E.SendError(w, r, nil, http.StatusBadRequest, "invalid state")
 		return
 	}
@@ -150,10 +161,10 @@ func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repo, err := gh.Repo(r.Context(), user.Login, repoName)
+	repo, err := gh.Repo(r.Context(), user.Login, course.RepoName)
 	if err != nil {
 		if e, ok := err.(*github.ErrorResponse); ok && e.NotFound() {
-			repo, err = gh.CreateRepoFromTemplate(r.Context(), "mkuznets/stdlib-template", repoName, true)
+			repo, err = gh.CreateRepoFromTemplate(r.Context(), course.Template, course.RepoName, true)
 			if err != nil {
 				E.Handle(w, r, errors.Wrap(err, "could not create a repo"))
 				return
@@ -171,20 +182,18 @@ func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 	)
 	err = db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
 		err := tx.QueryRow(r.Context(), `
-		INSERT INTO users ("github_id", "login", "email", "repository_id", "repository_name")
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO users ("github_id", "login", "email")
+		VALUES ($1, $2, $3)
 		ON CONFLICT ("github_id") DO UPDATE
 		SET
 			email=EXCLUDED.email,
-			repository_id=EXCLUDED.repository_id,
-			repository_name=EXCLUDED.repository_name,
 			login=EXCLUDED.login
 		RETURNING id, honor_code, installation_id
-		`, user.ID, user.Login, user.Email, repo.ID, repo.Name).Scan(&userId, &honourCode, &instId)
+		`, user.ID, user.Login, user.Email).Scan(&userId, &honourCode, &instId)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		return nil
+		return enroll(r.Context(), tx, userId, course.Id, repo)
 	})
 	if err != nil {
 		E.Handle(w, r, err)
@@ -222,7 +231,7 @@ func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 		} else {
 			finalPath = "/signin?step=honour_code"
 		}
-		finishUrl := fmt.Sprintf("%s%s", api.WebUrl, finalPath)
+		finishUrl := fmt.Sprintf("%s/%s%s", api.WebUrl, course.Name, finalPath)
 		render.JSON(w, r, models.AuthStage{
 			Session: session,
 			Url:     finishUrl,
@@ -231,7 +240,7 @@ func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	redirectToInstall := func() {
 		installUrl := fmt.Sprintf("https://github.com/apps/%s/installations/new/permissions"+
-			"?suggested_target_id=%d&repository_ids[]=%d&state=%s", api.App.Name, user.ID, repo.ID, api.RandomState)
+			"?suggested_target_id=%d&repository_ids[]=%d&state=%s", api.App.Name, user.ID, repo.ID, api.oauthState(course))
 		render.JSON(w, r, models.AuthStage{
 			Url: installUrl,
 		})
@@ -287,6 +296,7 @@ func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) InstallApp(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	data := models.AppInstallData{}
 	if err := render.DecodeJSON(r.Body, &data); err != nil {
@@ -294,7 +304,7 @@ func (api *API) InstallApp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if api.RandomState != data.State {
+	if api.oauthState(course) != data.State {
 		E.SendError(w, r, nil, http.StatusBadRequest, "invalid state")
 		return
 	}
@@ -313,13 +323,12 @@ func (api *API) InstallApp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var (
-		login, repoName string
-		userId          uint64
-		honourCode      bool
+		userId     uint64
+		honourCode bool
 	)
 	err = api.DB.QueryRow(r.Context(), `
-	SELECT id, login, repository_name, honor_code FROM "users" WHERE "github_id"=$1 LIMIT 1
-	`, inst.Account.ID).Scan(&userId, &login, &repoName, &honourCode)
+	SELECT id, honor_code FROM "users" WHERE "github_id"=$1 LIMIT 1
+	`, inst.Account.ID).Scan(&userId, &honourCode)
 	switch {
 	case err == pgx.ErrNoRows:
 		e := fmt.Errorf("user not found: %s (id=%d)", inst.Account.Login, inst.Account.ID)
@@ -356,7 +365,7 @@ func (api *API) InstallApp(w http.ResponseWriter, r *http.Request) {
 	} else {
 		finalPath = "/signin?step=honour_code"
 	}
-	finishUrl := fmt.Sprintf("%s%s", api.WebUrl, finalPath)
+	finishUrl := fmt.Sprintf("%s/%s%s", api.WebUrl, course.Name, finalPath)
 	render.JSON(w, r, &models.AuthStage{Session: session, Url: finishUrl})
 }
 
@@ -371,3 +380,16 @@ func createSession(ctx context.Context, tx pgx.Tx, userId uint64) (string, error
 	}
 	return session, nil
 }
+
+func enroll(ctx context.Context, tx pgx.Tx, userId, courseId uint64, repo *github.Repo) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO enrollments (user_id, course_id, repository_id, repository_name)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, course_id) DO UPDATE
+		SET repository_id=EXCLUDED.repository_id, repository_name=EXCLUDED.repository_name
+		`, userId, courseId, repo.ID, repo.Name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
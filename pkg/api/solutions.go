@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/mkuznets/classbox/pkg/db"
 
 	"github.com/go-chi/render"
@@ -20,6 +21,7 @@ type Solution struct {
 }
 
 func (api *API) GetSolutions(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	rows, err := api.DB.Query(r.Context(), `
 	SELECT
@@ -32,9 +34,9 @@ func (api *API) GetSolutions(w http.ResponseWriter, r *http.Request) {
 		JOIN tasks AS t ON (t.commit_id=ci.id)
 		JOIN tests as te ON (te.id=ch.test_id)
 	WHERE
-		ch.status='success' AND ch.is_cached='f' AND ch.name LIKE 'test::%'
+		ch.status='success' AND ch.is_cached='f' AND ch.name LIKE 'test::%' AND ci.course_id=$1
 	ORDER BY ci.user_id, ch.test_id, ci.id ASC;
-	`)
+	`, course.Id)
 	if err != nil {
 		E.Handle(w, r, errors.WithStack(err))
 		return
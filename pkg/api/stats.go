@@ -13,24 +13,28 @@ import (
 )
 
 func (api *API) GetStats(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	rows, err := api.DB.Query(r.Context(), `
-	SELECT u.login, COALESCE(st.score, 0) as score, COALESCE(st.count, 0) as count
-	FROM users as u LEFT JOIN (
-		SELECT u.id as user_id, SUM(s.score) as score, COUNT(*) as count
+	SELECT u.login, COALESCE(st.score, 0) as score, COALESCE(st.count, 0) as count, COALESCE(st.stale, 0) as stale
+	FROM users as u JOIN enrollments as e ON (e.user_id=u.id) LEFT JOIN (
+		SELECT u.id as user_id, SUM(s.score * s.credit) as score, COUNT(*) FILTER (WHERE s.status='success') as count,
+			COUNT(*) FILTER (WHERE s.course_version < co.version) as stale
 		FROM (
-			SELECT DISTINCT ON (ch.test_id, ci.user_id) ci.user_id, t.score, ch.status
+			SELECT DISTINCT ON (ch.test_id, ci.user_id) ci.user_id, t.score, ch.status, ch.credit, ch.course_version
 			FROM checks as ch
 				JOIN commits as ci ON (ci.id=ch.commit_id)
 				JOIN tests as t ON (t.id=ch.test_id)
-			WHERE ch.test_id IS NOT NULL AND t.is_deleted='f'
+			WHERE ch.test_id IS NOT NULL AND ch.is_graded AND ci.course_id=$1 AND t.is_deleted='f'
 			ORDER BY ch.test_id, ci.user_id, ch.id DESC
 		) as s
 		JOIN users as u ON (u.id=s.user_id)
-		WHERE s.status='success' GROUP BY u.id
+		JOIN courses as co ON (co.id=$1)
+		WHERE s.credit > 0 GROUP BY u.id
 	) as st ON (u.id=st.user_id)
+	WHERE e.course_id=$1
 	ORDER BY score DESC, login;
-	`)
+	`, course.Id)
 	if err != nil {
 		E.Handle(w, r, errors.WithStack(err))
 		return
@@ -40,7 +44,7 @@ func (api *API) GetStats(w http.ResponseWriter, r *http.Request) {
 
 	err = db.IterRows(rows, func(rows pgx.Rows) error {
 		s := models.Stat{}
-		err := rows.Scan(&s.Login, &s.Score, &s.Count)
+		err := rows.Scan(&s.Login, &s.Score, &s.Count, &s.Stale)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -2,10 +2,12 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -16,121 +18,436 @@ import (
 	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/mkuznets/classbox/pkg/db"
 	"github.com/mkuznets/classbox/pkg/github"
-	"github.com/mkuznets/classbox/pkg/s3"
 	"github.com/mkuznets/classbox/pkg/utils"
 	"github.com/mkuznets/classbox/pkg/web"
 	"github.com/pkg/errors"
 )
 
+const (
+	// maxWait is the longest a long-polling request can wait, it is kept
+	// well below the server timeout to leave time for dequeueing the task,
+	// which fetches its archive.
+	maxWait      = 15 * time.Second
+	pollInterval = 5 * time.Second
+)
+
+// Priorities of tasks, tasks with higher priorities are dequeued first
+const (
+	priorityInteractive = 0   // pushes and re-runs requested by users
+	priorityBulk        = -5  // bulk re-runs by the course staff
+	priorityRegrade     = -10 // regrades after course upgrades
+)
+
+// Origins of tasks, only tasks of pushes are superseded by newer commits
+const (
+	originPush    = "push"    // commits reported by webhooks
+	originRerun   = "rerun"   // re-runs requested by users or the course staff
+	originRegrade = "regrade" // regrades after course upgrades
+)
+
+// EnqueueTask stores a Github webhook and checks the commit it refers to.
+// Deliveries that have already been processed are ignored.
 func (api *API) EnqueueTask(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("X-GitHub-Event") != "check_suite" {
-		render.NoContent(w, r)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		E.Handle(w, r, errors.Wrap(err, "could not read request body"))
 		return
 	}
 
-	if time.Now().After(api.Deadline) {
-		log.Print("[INFO] Deadline passed")
-		render.NoContent(w, r)
+	d, err := api.saveDelivery(r.Context(), r.Header, body)
+	if err != nil {
+		E.Handle(w, r, err)
 		return
 	}
-
-	deliveryID := r.Header.Get("X-GitHub-Delivery")
-	if deliveryID != "" {
-		log.Printf("[INFO] Webhook %s", deliveryID)
-	}
-
-	cs := github.CheckSuiteEvent{}
-	if err := render.DecodeJSON(r.Body, &cs); err != nil {
-		E.SendError(w, r, nil, http.StatusBadRequest, "invalid input")
+	if d == nil {
+		render.NoContent(w, r)
 		return
 	}
-	if cs.Action != "requested" && cs.Action != "rerequested" {
-		render.NoContent(w, r)
+
+	if err := api.processDelivery(r.Context(), d); err != nil {
+		E.Handle(w, r, err)
 		return
 	}
+	render.NoContent(w, r)
+}
 
-	var userID uint64
-	err := api.DB.QueryRow(r.Context(), `
-	SELECT "id" FROM "users" WHERE "github_id"=$1 AND "repository_id"=$2 LIMIT 1
-	`, cs.Sender.ID, cs.Repo.ID).Scan(&userID)
+// enqueueHook checks the commit of a webhook unless it has already been
+// checked and returns the outcome of the delivery.
+func (api *API) enqueueHook(ctx context.Context, hc *hookCommit) (string, error) {
+	var (
+		userID     uint64
+		courseID   uint64
+		courseName string
+	)
+	err := api.DB.QueryRow(ctx, `
+	SELECT u.id, co.id, co.name
+	FROM users AS u
+		JOIN enrollments AS e ON (e.user_id=u.id)
+		JOIN courses AS co ON (co.id=e.course_id)
+	WHERE u.github_id=$1 AND e.repository_id=$2 LIMIT 1
+	`, hc.Sender.ID, hc.Repo.ID).Scan(&userID, &courseID, &courseName)
 
 	switch {
 	case err == pgx.ErrNoRows:
-		e := fmt.Errorf("user not found: %s (id=%d)", cs.Sender.Login, cs.Sender.ID)
-		E.SendError(w, r, e, http.StatusBadRequest, e.Error())
-		return
+		e := fmt.Errorf("user not found: %s (id=%d, repo=%d)", hc.Sender.Login, hc.Sender.ID, hc.Repo.ID)
+		return "", E.New(e, http.StatusBadRequest, e.Error())
 	case err != nil:
-		E.Handle(w, r, err)
-		return
+		return "", err
 	}
 
-	appToken, err := api.App.Token()
+	// The same commit can be reported by several events, e.g. by a push
+	// and by a pull request. It is only checked again on request.
+	var knownID uint64
+	if hc.Rerequested {
+		err := api.DB.QueryRow(ctx, `
+		SELECT id FROM commits WHERE user_id=$1 AND course_id=$2 AND commit=$3
+		`, userID, courseID, hc.Head).Scan(&knownID)
+		if err != nil && err != pgx.ErrNoRows {
+			return "", errors.WithStack(err)
+		}
+	} else {
+		tag, err := api.DB.Exec(ctx, `
+		UPDATE commits SET pull_request=COALESCE(NULLIF($4, 0), pull_request)
+		WHERE user_id=$1 AND course_id=$2 AND commit=$3
+		`, userID, courseID, hc.Head, hc.Pull)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if tag.RowsAffected() > 0 {
+			log.Printf("[INFO] %s:%s has already been checked", hc.Repo.Owner.Login, hc.Head)
+			return deliveryIgnored, nil
+		}
+	}
+
+	gh, err := api.installation(ctx, hc.Inst.ID)
 	if err != nil {
-		E.Handle(w, r, errors.Wrap(err, "could not get app token"))
-		return
+		return "", err
 	}
-	gh := github.New(appToken)
-	if err := gh.AuthAsInstallation(r.Context(), cs.Inst.ID); err != nil {
-		E.Handle(w, r, errors.Wrap(err, "could not auth as installation"))
-		return
+
+	late, err := api.lateTests(ctx, courseID, userID, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if late.rejectsAll() {
+		log.Printf("[INFO] Deadline passed for %s in %s", hc.Sender.Login, courseName)
+		_, err := gh.CreateCheckRun(
+			ctx, hc.Repo.Owner.Login, hc.Repo.Name,
+			&github.CheckRun{
+				Name:           fmt.Sprintf("%s tests", courseName),
+				Commit:         hc.Head,
+				Status:         "completed",
+				Conclusion:     "neutral",
+				CompletionTime: time.Now().UTC().Format(time.RFC3339),
+				Output: &github.CheckRunOutput{
+					Title:   "Not graded: the deadline has passed",
+					Summary: lateSummary(late),
+				},
+			},
+		)
+		if err != nil {
+			return "", errors.Wrap(err, "could not create a check run")
+		}
+		return deliveryProcessed, nil
+	}
+
+	// Re-runs of recorded commits do not count against the quota, they are
+	// limited the same way as re-runs requested on the website.
+	var usage []*models.Quota
+	if knownID != 0 {
+		err := db.Tx(ctx, api.DB, func(tx pgx.Tx) error {
+			user := &models.User{Id: userID}
+			if err := api.checkRerunLimit(ctx, tx, &rerunTarget{commitID: knownID}, user); err != nil {
+				return err
+			}
+			return recordRerun(ctx, tx, knownID, user)
+		})
+		if e, ok := err.(*E.APIError); ok {
+			switch e.Code {
+			case http.StatusConflict:
+				log.Printf("[INFO] %s:%s is being checked", hc.Repo.Owner.Login, hc.Head)
+				return deliveryIgnored, nil
+			case http.StatusTooManyRequests:
+				log.Printf("[INFO] Re-run limit exceeded for %s in %s", hc.Sender.Login, courseName)
+				_, err := gh.CreateCheckRun(
+					ctx, hc.Repo.Owner.Login, hc.Repo.Name,
+					&github.CheckRun{
+						Name:           fmt.Sprintf("%s tests", courseName),
+						Commit:         hc.Head,
+						Status:         "completed",
+						Conclusion:     "neutral",
+						CompletionTime: time.Now().UTC().Format(time.RFC3339),
+						Output: &github.CheckRunOutput{
+							Title:   "Rate limited: too many re-runs",
+							Summary: fmt.Sprintf("Commits can be re-run at most %d times per hour.", api.RerunLimit),
+						},
+					},
+				)
+				if err != nil {
+					return "", errors.Wrap(err, "could not create a check run")
+				}
+				return deliveryProcessed, nil
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	} else {
+		usage, err = api.quotaUsage(ctx, courseID, userID, time.Now())
+		if err != nil {
+			return "", err
+		}
+	}
+	if retryAt := quotaExceeded(usage); retryAt != nil {
+		log.Printf("[INFO] Quota exceeded for %s in %s", hc.Sender.Login, courseName)
+		_, err := gh.CreateCheckRun(
+			ctx, hc.Repo.Owner.Login, hc.Repo.Name,
+			&github.CheckRun{
+				Name:           fmt.Sprintf("%s tests", courseName),
+				Commit:         hc.Head,
+				Status:         "completed",
+				Conclusion:     "neutral",
+				CompletionTime: time.Now().UTC().Format(time.RFC3339),
+				Output: &github.CheckRunOutput{
+					Title:   fmt.Sprintf("Rate limited, try again at %s", retryAt.UTC().Format("15:04 MST")),
+					Summary: quotaSummary(usage),
+				},
+			},
+		)
+		if err != nil {
+			return "", errors.Wrap(err, "could not create a check run")
+		}
+		return deliveryProcessed, nil
 	}
 
 	checkRun, err := gh.CreateCheckRun(
-		r.Context(), cs.Repo.Owner.Login, cs.Repo.Name,
-		&github.CheckRun{
-			Name:   "stdlib tests",
-			Commit: cs.CheckSuite.Head,
-			Status: "queued",
-			Url:    fmt.Sprintf("%s/commit/%s:%s", api.WebUrl, cs.Repo.Owner.Login, cs.CheckSuite.Head),
-		},
+		ctx, hc.Repo.Owner.Login, hc.Repo.Name,
+		api.queuedCheckRun(courseName, hc.Repo.Owner.Login, hc.Head),
 	)
 	if err != nil {
-		E.Handle(w, r, errors.Wrap(err, "could not create a check run"))
-		return
+		return "", errors.Wrap(err, "could not create a check run")
 	}
 
-	err = db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
-
-		var commitID uint64
-
-		err = tx.QueryRow(r.Context(), `
-		INSERT INTO commits ("user_id", "commit", "check_run_id")
-		VALUES ($1, $2, $3)
-		ON CONFLICT (user_id, commit) DO UPDATE
-		SET check_run_id=EXCLUDED.check_run_id, is_checked='f'
-		RETURNING "id"
-		`, userID, cs.CheckSuite.Head, checkRun.ID).Scan(&commitID)
-
-		switch {
-		case err == pgx.ErrNoRows: // conflict, the same commit
-			return E.New(nil, http.StatusNoContent, "existing commit")
-		case err != nil:
-			return errors.WithStack(err)
+	var superseded []*queuedCommit
+	err = db.Tx(ctx, api.DB, func(tx pgx.Tx) error {
+		origin := originPush
+		if knownID != 0 {
+			origin = originRerun
 		}
-
-		_, err = tx.Exec(r.Context(), `
-		INSERT INTO "tasks" ("commit_id") VALUES ($1) ON CONFLICT (commit_id) DO UPDATE SET status='enqueued';`, commitID)
+		commitID, err := enqueueCommit(ctx, tx, userID, courseID, hc.Head, checkRun.ID, priorityInteractive, origin)
 		if err != nil {
-			return errors.WithStack(err)
+			return err
+		}
+		if hc.Pull != 0 {
+			_, err := tx.Exec(ctx, `UPDATE commits SET pull_request=$2 WHERE id=$1`, commitID, hc.Pull)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if !api.Supersede {
+			return nil
 		}
+		superseded, err = supersedeCommits(ctx, tx, commitID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
 
-		_, err = tx.Exec(r.Context(), `
-		DELETE FROM "checks" WHERE commit_id=$1;`, commitID)
+	for _, c := range superseded {
+		log.Printf("[INFO] %s:%s superseded by %s", hc.Repo.Owner.Login, c.hash, hc.Head)
+		err := gh.UpdateCheckRun(ctx, hc.Repo.Owner.Login, hc.Repo.Name, &github.CheckRun{
+			ID:             c.checkRunID,
+			Status:         "completed",
+			Conclusion:     "skipped",
+			CompletionTime: time.Now().UTC().Format(time.RFC3339),
+			Output: &github.CheckRunOutput{
+				Title:   "Skipped: superseded by a newer commit",
+				Summary: fmt.Sprintf("The tests are run for %s instead.", hc.Head),
+			},
+		})
 		if err != nil {
-			return errors.WithStack(err)
+			log.Printf("[ERR] could not update check run of superseded commit %s: %v", c.hash, err)
 		}
+	}
+
+	return deliveryProcessed, nil
+}
+
+// queuedCommit is an enqueued commit of a user
+type queuedCommit struct {
+	taskID      string
+	hash        string
+	checkRunID  uint64
+	origin      string
+	submittedAt time.Time
+}
 
+// supersedes reports whether a commit submitted at the given time makes the
+// enqueued one unnecessary. Only pushes submitted before it are skipped,
+// re-runs and regrades have been asked for and reuse their check runs.
+func supersedes(submittedAt time.Time, c *queuedCommit) bool {
+	return c.origin == originPush && c.submittedAt.Before(submittedAt)
+}
+
+// supersedeCommits skips the enqueued tasks of the user's commits superseded
+// by the given one.
+func supersedeCommits(ctx context.Context, tx pgx.Tx, commitID uint64) ([]*queuedCommit, error) {
+	rows, err := tx.Query(ctx, `
+	SELECT t.id::text, c.commit, c.check_run_id, t.origin, c.submitted_at, newer.submitted_at
+	FROM tasks AS t
+		JOIN commits AS c ON (c.id=t.commit_id)
+		JOIN commits AS newer ON (newer.user_id=c.user_id AND newer.course_id=c.course_id)
+	WHERE newer.id=$1 AND c.id<>newer.id AND t.status='enqueued'
+	FOR UPDATE OF t
+	`, commitID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var (
+		commits []*queuedCommit
+		taskIDs []string
+	)
+	err = db.IterRows(rows, func(rows pgx.Rows) error {
+		var (
+			c           queuedCommit
+			submittedAt time.Time
+		)
+		if err := rows.Scan(&c.taskID, &c.hash, &c.checkRunID, &c.origin, &c.submittedAt, &submittedAt); err != nil {
+			return errors.WithStack(err)
+		}
+		if supersedes(submittedAt, &c) {
+			commits = append(commits, &c)
+			taskIDs = append(taskIDs, c.taskID)
+		}
 		return nil
 	})
+	if err != nil || len(commits) == 0 {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `
+	UPDATE tasks SET status='skipped', finished_at=STATEMENT_TIMESTAMP() WHERE id::text=ANY($1)
+	`, taskIDs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return commits, nil
+}
+
+// installation returns a Github client authenticated as the app installation
+func (api *API) installation(ctx context.Context, instID int) (*github.Client, error) {
+	appToken, err := api.App.Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get app token")
+	}
+	gh := github.New(appToken)
+	if err := gh.AuthAsInstallation(ctx, instID); err != nil {
+		return nil, errors.Wrap(err, "could not auth as installation")
+	}
+	return gh, nil
+}
+
+func (api *API) queuedCheckRun(courseName, login, commitHash string) *github.CheckRun {
+	return &github.CheckRun{
+		Name:   fmt.Sprintf("%s tests", courseName),
+		Commit: commitHash,
+		Status: "queued",
+		Url:    api.commitURL(courseName, login, commitHash),
+	}
+}
+
+// enqueueCommit (re)creates the task of the commit. The checks of its
+// previous runs are kept until the task is finished, so that scores do not
+// drop while the commit is re-checked. The commit is attached to the given
+// check run, the task records its origin.
+func enqueueCommit(ctx context.Context, tx pgx.Tx, userID, courseID uint64, commitHash string, checkRunID uint64, priority int, origin string) (uint64, error) {
+	var commitID uint64
+
+	err := tx.QueryRow(ctx, `
+	INSERT INTO commits ("user_id", "course_id", "commit", "check_run_id")
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (user_id, course_id, commit) DO UPDATE
+	SET check_run_id=EXCLUDED.check_run_id, is_checked='f'
+	RETURNING "id"
+	`, userID, courseID, commitHash, checkRunID).Scan(&commitID)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO "tasks" ("commit_id", "priority", "origin") VALUES ($1, $2, $3)
+	ON CONFLICT (commit_id) DO UPDATE
+	SET status='enqueued', enqueued_at=CURRENT_TIMESTAMP, started_at=NULL, finished_at=NULL,
+		runner_id=NULL, lease_expires_at=NULL, retries=0, priority=EXCLUDED.priority, origin=EXCLUDED.origin;`,
+		commitID, priority, origin)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return commitID, nil
+}
+
+func (api *API) DequeueTask(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	runnerID := r.Header.Get("X-Runner-ID")
+	if _, err := uuid.Parse(runnerID); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "valid runner id is required")
+		return
+	}
+
+	// Long polling: wait for a notification about enqueued tasks and
+	// additionally poll in case notifications are unavailable.
+	wait, err := parseWait(r)
 	if err != nil {
 		E.Handle(w, r, err)
 		return
 	}
+	timeout := time.After(wait)
 
-	render.NoContent(w, r)
+	for {
+		notified := api.tasks.wait(course.Id)
+
+		task, err := api.dequeue(r.Context(), course, runnerID)
+		if e, ok := err.(*E.APIError); ok && e.Code == http.StatusNoContent && wait > 0 {
+			select {
+			case <-notified:
+				continue
+			case <-time.After(pollInterval):
+				continue
+			case <-timeout:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if err != nil {
+			E.Handle(w, r, err)
+			return
+		}
+		render.JSON(w, r, task)
+		return
+	}
 }
 
-func (api *API) DequeueTask(w http.ResponseWriter, r *http.Request) {
+// parseWait returns the long polling time requested in ?wait=<seconds>
+func parseWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0, E.New(err, http.StatusBadRequest, "invalid wait")
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait, nil
+}
+
+func (api *API) dequeue(ctx context.Context, course *models.Course, runnerID string) (*models.Task, error) {
 
 	var (
 		taskID                                  string
@@ -140,18 +457,28 @@ func (api *API) DequeueTask(w http.ResponseWriter, r *http.Request) {
 		commitHash, login, repoName, archiveURL string
 	)
 
-	err := db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+	err := db.Tx(ctx, api.DB, func(tx pgx.Tx) error {
 
-		err := tx.QueryRow(r.Context(), `
-		UPDATE tasks SET status='executing', started_at=STATEMENT_TIMESTAMP()
+		err := tx.QueryRow(ctx, `
+		UPDATE tasks
+		SET status='executing',
+			started_at=STATEMENT_TIMESTAMP(),
+			runner_id=$2,
+			lease_expires_at=STATEMENT_TIMESTAMP() + $3 * interval '1 second'
 		WHERE id=(
-			SELECT id FROM tasks
-			WHERE status='enqueued'
-			ORDER BY id
-			FOR UPDATE SKIP LOCKED
+			-- Round-robin across users within a priority: users whose
+			-- tasks have been started least recently go first.
+			SELECT t.id FROM tasks AS t JOIN commits AS c ON (c.id=t.commit_id)
+			WHERE t.status='enqueued' AND c.course_id=$1
+			ORDER BY t.priority DESC, (
+				SELECT MAX(pt.started_at)
+				FROM tasks AS pt JOIN commits AS pc ON (pc.id=pt.commit_id)
+				WHERE pc.user_id=c.user_id AND pc.course_id=c.course_id
+			) NULLS FIRST, t.enqueued_at
+			FOR UPDATE OF t SKIP LOCKED
 			LIMIT 1
 		) RETURNING id, commit_id
-		;`).Scan(&taskID, &commitID)
+		;`, course.Id, runnerID, api.TaskLease.Seconds()).Scan(&taskID, &commitID)
 
 		switch {
 		case err == pgx.ErrNoRows:
@@ -160,9 +487,17 @@ func (api *API) DequeueTask(w http.ResponseWriter, r *http.Request) {
 			return errors.WithStack(err)
 		}
 
-		err = api.DB.QueryRow(r.Context(), `
-		SELECT u.login, c.commit, u.repository_name, u.installation_id, c.check_run_id
-		FROM commits AS c JOIN users as u ON(u.id=c.user_id)
+		// stages reported by aborted attempts are no longer relevant
+		_, err = tx.Exec(ctx, `DELETE FROM progress WHERE task_id=$1`, taskID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = api.DB.QueryRow(ctx, `
+		SELECT u.login, c.commit, e.repository_name, u.installation_id, c.check_run_id
+		FROM commits AS c
+			JOIN users as u ON(u.id=c.user_id)
+			JOIN enrollments as e ON(e.user_id=u.id AND e.course_id=c.course_id)
 		WHERE c.id=$1 AND u.installation_id IS NOT NULL LIMIT 1
 		;`, commitID).Scan(&login, &commitHash, &repoName, &instID, &checkRunId)
 
@@ -174,13 +509,9 @@ func (api *API) DequeueTask(w http.ResponseWriter, r *http.Request) {
 			return errors.WithStack(err)
 		}
 
-		appToken, err := api.App.Token()
+		gh, err := api.installation(ctx, instID)
 		if err != nil {
-			return errors.Wrap(err, "could not get app token")
-		}
-		gh := github.New(appToken)
-		if err := gh.AuthAsInstallation(r.Context(), instID); err != nil {
-			return errors.Wrap(err, "could not auth as installation")
+			return err
 		}
 
 		checkRun := &github.CheckRun{
@@ -188,42 +519,94 @@ func (api *API) DequeueTask(w http.ResponseWriter, r *http.Request) {
 			Status:    "in_progress",
 			StartTime: time.Now().UTC().Format(time.RFC3339),
 		}
-		if err := gh.UpdateCheckRun(r.Context(), login, repoName, checkRun); err != nil {
+		if err := gh.UpdateCheckRun(ctx, login, repoName, checkRun); err != nil {
 			return errors.Wrap(err, "could not update check run")
 		}
 
-		archive, err := gh.Archive(r.Context(), login, repoName, commitHash)
+		archive, err := gh.Archive(ctx, login, repoName, commitHash)
 		if err != nil {
 			return errors.Wrap(err, "could not download archive")
 		}
 
-		s3Client := s3.New(api.AWS.Session(), api.AWS.Bucket)
-		archiveKey := fmt.Sprintf("%s/%s/%s/%s.zip", api.EnvType, login, repoName, commitHash)
-		err = s3Client.Upload(r.Context(), archiveKey, bytes.NewBuffer(archive))
+		archiveKey := fmt.Sprintf("%s/%s/%s/%s/%s.zip", api.EnvType, course.Name, login, repoName, commitHash)
+		err = api.Blobs.Upload(ctx, archiveKey, bytes.NewBuffer(archive))
 		if err != nil {
-			return errors.Wrap(err, "could not upload archive to S3")
+			return errors.Wrap(err, "could not upload archive")
 		}
 
-		archiveURL, err = s3Client.URL(r.Context(), archiveKey)
+		archiveURL, err = api.Blobs.URL(ctx, archiveKey)
 		if err != nil {
-			return errors.Wrap(err, "could not get S3 URL")
+			return errors.Wrap(err, "could not get archive URL")
 		}
 		return nil
 	})
 
 	if err != nil {
-		E.Handle(w, r, err)
-		return
+		return nil, err
 	}
 
-	render.JSON(w, r, &models.Task{
+	return &models.Task{
 		Id:  taskID,
 		Ref: fmt.Sprintf("%s:%s", login, commitHash[:8]),
 		Url: archiveURL,
-	})
+	}, nil
 }
 
 func (api *API) FinishTask(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
+
+	taskID := chi.URLParam(r, "taskID")
+	if _, err := uuid.Parse(taskID); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+
+	if err := api.checkLease(r.Context(), course.Id, taskID, r.Header.Get("X-Runner-ID")); err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	var stages []*models.Stage
+	if err := render.DecodeJSON(r.Body, &stages); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
+		return
+	}
+	if len(stages) == 0 {
+		E.SendError(w, r, nil, http.StatusBadRequest, "stage list cannot be empty")
+		return
+	}
+
+	if err := api.completeTask(r.Context(), taskID, stages); err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// checkLease ensures that the task of the course is leased by the runner
+func (api *API) checkLease(ctx context.Context, courseID uint64, taskID, runnerID string) error {
+	var leasedBy *string
+	err := api.DB.QueryRow(ctx, `
+	SELECT t.runner_id::text FROM tasks AS t JOIN commits AS c ON (c.id=t.commit_id)
+	WHERE t.id=$1 AND c.course_id=$2 LIMIT 1
+	`, taskID, courseID).Scan(&leasedBy)
+	switch {
+	case err == pgx.ErrNoRows:
+		e := fmt.Errorf("unknown task: %v", taskID)
+		return E.New(e, http.StatusNotFound, e.Error())
+	case err != nil:
+		return errors.WithStack(err)
+	case leasedBy == nil || *leasedBy != runnerID:
+		return E.New(nil, http.StatusConflict, "task is not leased by the runner")
+	}
+	return nil
+}
+
+// ReleaseTask hands the task back to the queue, e.g. when its runner is
+// shutting down. The retry counter is not affected.
+func (api *API) ReleaseTask(w http.ResponseWriter, r *http.Request) {
+	course := r.Context().Value("Course").(*models.Course)
 
 	taskID := chi.URLParam(r, "taskID")
 	if _, err := uuid.Parse(taskID); err != nil {
@@ -231,6 +614,35 @@ func (api *API) FinishTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	runnerID := r.Header.Get("X-Runner-ID")
+	if _, err := uuid.Parse(runnerID); err != nil {
+		E.SendError(w, r, err, http.StatusBadRequest, "valid runner id is required")
+		return
+	}
+
+	ct, err := api.DB.Exec(r.Context(), `
+	UPDATE tasks
+	SET status='enqueued', started_at=NULL, runner_id=NULL, lease_expires_at=NULL
+	WHERE id=$1 AND runner_id=$2 AND status='executing'
+		AND commit_id IN (SELECT id FROM commits WHERE course_id=$3)
+	`, taskID, runnerID, course.Id)
+	if err != nil {
+		E.Handle(w, r, errors.WithStack(err))
+		return
+	}
+	if ct.RowsAffected() == 0 {
+		E.SendError(w, r, nil, http.StatusConflict, "task is not leased by the runner")
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// completeTask saves the stages as checks of the task's commit, marks the task
+// as finished and completes the Github check run. Pull requests with failed
+// stages are reviewed if enabled.
+func (api *API) completeTask(ctx context.Context, taskID string, stages []*models.Stage) error {
+
 	var (
 		commitId    uint64
 		commitHash  string
@@ -238,50 +650,49 @@ func (api *API) FinishTask(w http.ResponseWriter, r *http.Request) {
 		checkRun    github.CheckRun
 		login, repo string
 		instId      int
+		course      models.Course
+		userID      uint64
+		submittedAt time.Time
+		version     uint64
+		pull        *int
 	)
 
-	err := api.DB.QueryRow(r.Context(), `
-	SELECT c.id, c.commit, c.is_checked, c.check_run_id, u.login, u.repository_name, u.installation_id
+	err := api.DB.QueryRow(ctx, `
+	SELECT c.id, c.commit, c.is_checked, c.check_run_id, c.submitted_at, c.pull_request,
+		u.id, u.login, e.repository_name, u.installation_id, co.id, co.name, co.version
 	FROM
 		commits AS c
 		JOIN tasks AS t ON(c.id=t.commit_id)
 		JOIN users AS u ON (u.id=c.user_id)
+		JOIN enrollments AS e ON (e.user_id=u.id AND e.course_id=c.course_id)
+		JOIN courses AS co ON (co.id=c.course_id)
 	WHERE t.id=$1 LIMIT 1
-	;`, taskID).Scan(&commitId, &commitHash, &isChecked, &checkRun.ID, &login, &repo, &instId)
+	;`, taskID).Scan(&commitId, &commitHash, &isChecked, &checkRun.ID, &submittedAt, &pull,
+		&userID, &login, &repo, &instId, &course.Id, &course.Name, &version)
 	switch {
 	case err == pgx.ErrNoRows:
 		e := fmt.Errorf("unknown task: %v", taskID)
-		E.SendError(w, r, e, http.StatusNotFound, e.Error())
-		return
+		return E.New(e, http.StatusNotFound, e.Error())
 	case err != nil:
-		E.Handle(w, r, err)
-		return
+		return errors.WithStack(err)
 	case isChecked:
-		render.NoContent(w, r)
-		return
+		return nil
 	}
 
-	var stages []*models.Stage
-	if err = render.DecodeJSON(r.Body, &stages); err != nil {
-		E.SendError(w, r, err, http.StatusBadRequest, "invalid input")
-		return
-	}
-	if len(stages) == 0 {
-		E.SendError(w, r, err, http.StatusBadRequest, "stage list cannot be empty")
-		return
+	testNames := utils.UniqueStringFields(stages, "Test")
+	testIds, err := api.getTestIds(ctx, course.Id, testNames)
+	if err != nil {
+		return err
 	}
 
-	testNames := utils.UniqueStringFields(stages, "Test")
-	testIds, err := api.getTestIds(r.Context(), testNames)
+	runIds, err := api.getRunIds(ctx, stages)
 	if err != nil {
-		E.Handle(w, r, err)
-		return
+		return err
 	}
 
-	runIds, err := api.getRunIds(r.Context(), stages)
+	late, err := api.lateTests(ctx, course.Id, userID, submittedAt)
 	if err != nil {
-		E.Handle(w, r, err)
-		return
+		return err
 	}
 
 	var crows [][]interface{}
@@ -289,6 +700,7 @@ func (api *API) FinishTask(w http.ResponseWriter, r *http.Request) {
 		var (
 			testID *uint64
 			runID  *uint64
+			graded = late.apply(stage)
 		)
 		if stage.Test != "" {
 			if v, ok := testIds[stage.Test]; ok {
@@ -302,90 +714,147 @@ func (api *API) FinishTask(w http.ResponseWriter, r *http.Request) {
 				runID = &v
 			}
 		}
-		crows = append(crows, []interface{}{commitId, testID, runID, stage.Cached, stage.Name, stage.Status, stage.Output})
-	}
-
-	title := ""
-	failures := make([]string, 0)
-	for _, s := range stages {
-		if s.Status != "success" {
-			failures = append(failures, s.Name)
+		var logKey *string
+		if stage.LogKey != "" {
+			logKey = &stage.LogKey
 		}
+		crows = append(crows, []interface{}{commitId, testID, runID, stage.Cached, stage.Name, stage.Status, stage.Output, stage.Results, stage.Credit, graded, version, logKey})
 	}
+
+	var title string
 	checkRun.Status = "completed"
 	checkRun.CompletionTime = time.Now().UTC().Format(time.RFC3339)
-	if len(failures) > 0 {
-		checkRun.Conclusion = "failure"
-		title = fmt.Sprintf("Failed: %s", strings.Join(failures, " , "))
-	} else {
-		checkRun.Conclusion = "success"
-		title = "Success"
-	}
+	checkRun.Conclusion, title = checkRunConclusion(stages, late)
 
-	page := struct {
-		Stages []*models.Stage
-		Url    string
-	}{stages, fmt.Sprintf("%s/commit/%s:%s", api.WebUrl, login, commitHash)}
-
-	ts, err := web.NewTemplates()
-	if err != nil {
-		E.Handle(w, r, errors.WithStack(err))
-		return
-	}
-	tpl, err := ts.New("check_run")
+	summary, err := api.checkRunSummary(course.Name, login, commitHash, stages)
 	if err != nil {
-		E.Handle(w, r, errors.WithStack(err))
-		return
-	}
-	summary := bytes.NewBufferString("")
-	if err := tpl.ExecuteTemplate(summary, "markdown", page); err != nil {
-		E.Handle(w, r, errors.WithStack(err))
-		return
+		return err
 	}
 	checkRun.Output = &github.CheckRunOutput{
 		Title:   title,
-		Summary: summary.String(),
+		Summary: summary,
 	}
 
-	err = db.Tx(r.Context(), api.DB, func(tx pgx.Tx) error {
+	gh, err := api.installation(ctx, instId)
+	if err != nil {
+		return err
+	}
 
-		cols := []string{"commit_id", "test_id", "run_id", "is_cached", "name", "status", "output"}
-		cfr := pgx.CopyFromRows(crows)
-		_, err = tx.CopyFrom(r.Context(), pgx.Identifier{"checks"}, cols, cfr)
+	err = db.Tx(ctx, api.DB, func(tx pgx.Tx) error {
+
+		// checks of the previous runs are replaced
+		_, err := tx.Exec(ctx, `DELETE FROM checks WHERE commit_id=$1`, commitId)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		_, err = tx.Exec(r.Context(), `UPDATE commits SET is_checked='t' WHERE id=$1`, commitId)
+		cols := []string{"commit_id", "test_id", "run_id", "is_cached", "name", "status", "output", "results", "credit", "is_graded", "course_version", "log_key"}
+		cfr := pgx.CopyFromRows(crows)
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"checks"}, cols, cfr)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		_, err = tx.Exec(r.Context(), `
-		UPDATE tasks SET status='finished', finished_at=STATEMENT_TIMESTAMP() WHERE id=$1
-		`, taskID)
+		_, err = tx.Exec(ctx, `DELETE FROM progress WHERE task_id=$1`, taskID)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		appToken, err := api.App.Token()
+		_, err = tx.Exec(ctx, `UPDATE commits SET is_checked='t' WHERE id=$1`, commitId)
 		if err != nil {
-			return errors.Wrap(err, "could not get app token")
+			return errors.WithStack(err)
 		}
-		gh := github.New(appToken)
-		if err := gh.AuthAsInstallation(r.Context(), instId); err != nil {
-			return errors.Wrap(err, "could not authenticate as installation")
+
+		_, err = tx.Exec(ctx, `
+		UPDATE tasks SET status='finished', finished_at=STATEMENT_TIMESTAMP(), lease_expires_at=NULL WHERE id=$1
+		`, taskID)
+		if err != nil {
+			return errors.WithStack(err)
 		}
-		if err := gh.UpdateCheckRun(r.Context(), login, repo, &checkRun); err != nil {
+
+		if err := gh.UpdateCheckRun(ctx, login, repo, &checkRun); err != nil {
 			return errors.Wrap(err, "could not finalise check run")
 		}
 
 		return nil
 	})
 	if err != nil {
-		E.Handle(w, r, err)
-		return
+		return err
 	}
 
-	render.NoContent(w, r)
+	// Annotations may take several requests, so they are added once the
+	// check run is finalised and do not fail the task.
+	var files map[string]bool
+	if checkRun.Conclusion == "failure" {
+		files, err = commitFiles(ctx, gh, login, repo, commitHash)
+		if err != nil {
+			log.Printf("[WARN] could not annotate check run of %s:%s: %v", login, commitHash, err)
+		}
+	}
+	if ann := annotations(stages, files); len(ann) > 0 {
+		output := *checkRun.Output
+		output.Annotations = ann
+		err := gh.UpdateCheckRun(ctx, login, repo, &github.CheckRun{ID: checkRun.ID, Output: &output})
+		if err != nil {
+			log.Printf("[WARN] could not annotate check run of %s:%s: %v", login, commitHash, err)
+		}
+	}
+
+	// Check runs of tests are created one by one and may wait for the rate
+	// limit, so the runner is not kept waiting for them. They are awaited on
+	// shutdown.
+	if api.CheckRunsPer != checkRunsPerCommit {
+		api.background.Add(1)
+		go func() {
+			defer api.background.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), testCheckRunsTimeout)
+			defer cancel()
+			if err := api.createTestCheckRuns(ctx, gh, &course, login, repo, commitHash, stages, late, files); err != nil {
+				log.Printf("[WARN] could not create check runs of tests for %s:%s: %v", login, commitHash, err)
+			}
+		}()
+	}
+
+	if pull != nil && api.PullReviews && checkRun.Conclusion == "failure" {
+		body, err := api.reviewSummary(course.Name, login, commitHash, stages)
+		if err != nil {
+			return err
+		}
+		review := &github.Review{Commit: commitHash, Body: body, Event: "COMMENT"}
+		if err := gh.CreateReview(ctx, login, repo, *pull, review); err != nil {
+			log.Printf("[WARN] could not review pull request #%d of %s/%s: %v", *pull, login, repo, err)
+		}
+	}
+	return nil
+}
+
+// checkRunSummary renders the stages as the summary of a Github check run
+func (api *API) checkRunSummary(courseName, login, commitHash string, stages []*models.Stage) (string, error) {
+	page := struct {
+		Stages []*models.Stage
+		Url    string
+	}{stages, api.commitURL(courseName, login, commitHash)}
+	return renderMarkdown("check_run", page)
+}
+
+// commitURL returns the commit page on the website
+func (api *API) commitURL(courseName, login, commitHash string) string {
+	return fmt.Sprintf("%s/%s/commit/%s:%s", api.WebUrl, courseName, login, commitHash)
+}
+
+// renderMarkdown renders the markdown part of the web template
+func renderMarkdown(name string, data interface{}) (string, error) {
+	ts, err := web.NewTemplates()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	tpl, err := ts.New(name)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	out := bytes.NewBufferString("")
+	if err := tpl.ExecuteTemplate(out, "markdown", data); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return out.String(), nil
 }
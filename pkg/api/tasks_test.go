@@ -0,0 +1,27 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSupersedes(t *testing.T) {
+	at := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		commit     queuedCommit
+		superseded bool
+	}{
+		{"older push", queuedCommit{origin: originPush, submittedAt: at.Add(-time.Minute)}, true},
+		{"newer push", queuedCommit{origin: originPush, submittedAt: at.Add(time.Minute)}, false},
+		{"push at the same time", queuedCommit{origin: originPush, submittedAt: at}, false},
+		{"re-run of an older commit", queuedCommit{origin: originRerun, submittedAt: at.Add(-time.Hour)}, false},
+		{"regrade of an older commit", queuedCommit{origin: originRegrade, submittedAt: at.Add(-time.Hour)}, false},
+	}
+	for _, c := range cases {
+		if superseded := supersedes(at, &c.commit); superseded != c.superseded {
+			t.Errorf("%s: expected %v, got %v", c.name, c.superseded, superseded)
+		}
+	}
+}
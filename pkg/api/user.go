@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/render"
 	"github.com/jackc/pgx/v4"
@@ -25,17 +26,19 @@ func (api *API) GetUserStats(w http.ResponseWriter, r *http.Request) {
 		E.SendError(w, r, nil, http.StatusUnauthorized, "user not authenticated")
 		return
 	}
+	course := r.Context().Value("Course").(*models.Course)
 
 	rows, err := api.DB.Query(r.Context(), `
-	SELECT t.name, t.description, t.score, COALESCE(s.passed, 'f')
-	FROM tests as t LEFT JOIN (
-		SELECT DISTINCT ON (ch.test_id) ch.test_id, (ch.status='success') as passed
+	SELECT t.name, t.description, t.score, COALESCE(s.passed, 'f'), COALESCE(s.credit, 0),
+		COALESCE(s.course_version < co.version, 'f')
+	FROM tests as t JOIN courses as co ON (co.id=t.course_id) LEFT JOIN (
+		SELECT DISTINCT ON (ch.test_id) ch.test_id, (ch.status='success') as passed, ch.credit, ch.course_version
 		FROM checks as ch
 			JOIN commits as ci ON (ci.id=ch.commit_id)
 			JOIN tests as t ON (t.id=ch.test_id)
-		WHERE ci.user_id=$1 AND ch.test_id IS NOT NULL AND t.is_deleted='f'
+		WHERE ci.user_id=$1 AND ci.course_id=$2 AND ch.test_id IS NOT NULL AND ch.is_graded AND t.is_deleted='f'
 		ORDER BY ch.test_id, ch.id DESC
-	) as s ON(s.test_id=t.id) WHERE t.is_deleted='f' ORDER BY topic,name;`, user.Id)
+	) as s ON(s.test_id=t.id) WHERE t.course_id=$2 AND t.is_deleted='f' ORDER BY topic,name;`, user.Id, course.Id)
 	if err != nil {
 		E.Handle(w, r, errors.WithStack(err))
 		return
@@ -44,10 +47,12 @@ func (api *API) GetUserStats(w http.ResponseWriter, r *http.Request) {
 	var tests []*models.Test
 	err = db.IterRows(rows, func(rows pgx.Rows) error {
 		t := models.Test{}
-		err := rows.Scan(&t.Name, &t.Description, &t.Score, &t.Passed)
+		var credit float64
+		err := rows.Scan(&t.Name, &t.Description, &t.Score, &t.Passed, &credit, &t.Stale)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		t.Earned = float64(t.Score) * credit
 		tests = append(tests, &t)
 		return nil
 	})
@@ -56,12 +61,19 @@ func (api *API) GetUserStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats := &models.UserStats{Tests: tests, Score: 0}
+	quotas, err := api.quotaUsage(r.Context(), course.Id, user.Id, time.Now())
+	if err != nil {
+		E.Handle(w, r, err)
+		return
+	}
+
+	stats := &models.UserStats{Tests: tests, Score: 0, Quotas: quotas}
 	for _, t := range tests {
-		if t.Passed {
-			stats.Score += t.Score
-		}
+		stats.Score += t.Earned
 		stats.Total += t.Score
+		if t.Stale {
+			stats.Stale++
+		}
 	}
 	render.JSON(w, r, stats)
 }
@@ -0,0 +1,90 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// cli runs containers with the docker command line client
+type cli struct{}
+
+func (*cli) run(ctx context.Context, c *container) (*Result, error) {
+	name := fmt.Sprintf("classbox-%s", uuid.New().String())
+	args := []string{"run", "--rm", "--name", name}
+	for _, m := range c.Mounts {
+		spec := fmt.Sprintf("type=volume,source=%s,target=%s", m.Volume, m.Target)
+		if m.Subpath != "" {
+			spec += ",volume-subpath=" + m.Subpath
+		}
+		args = append(args, "--mount", spec)
+	}
+	if c.NoNetwork {
+		args = append(args, "--network", "none")
+	}
+	for _, opt := range c.SecurityOpt {
+		args = append(args, "--security-opt", opt)
+	}
+	for _, env := range c.Env {
+		args = append(args, "-e", env)
+	}
+	if c.Memory > 0 {
+		// no swap, so that exceeding the limit is an OOM kill rather than a slowdown
+		m := fmt.Sprintf("%dm", c.Memory)
+		args = append(args, "--memory", m, "--memory-swap", m)
+	}
+	if c.Cpus > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(c.Cpus, 'f', -1, 64))
+	}
+	if c.Pids > 0 {
+		args = append(args, "--pids-limit", strconv.FormatUint(c.Pids, 10))
+	}
+	args = append(args, c.Image)
+	args = append(args, c.Cmd...)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+
+	if ctx.Err() != nil {
+		// Killing the CLI does not stop the container.
+		if err := exec.Command("docker", "kill", name).Run(); err != nil {
+			log.Printf("[WARN] could not kill container %s: %v", name, err)
+		}
+		return nil, ctx.Err()
+	}
+
+	var result Result
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitError.ExitCode()
+		} else {
+			return nil, err
+		}
+	}
+	result.Output = out.Bytes()
+	return &result, nil
+}
+
+func (*cli) pull(ctx context.Context, image string, auth *RegistryAuth) error {
+	if auth != nil {
+		cmd := exec.CommandContext(ctx, "docker", "login", "-u", auth.Username, "-p", auth.Password, auth.Host)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return errors.Wrap(err, string(out))
+		}
+	}
+	cmd := exec.CommandContext(ctx, "docker", "pull", image)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrap(err, string(out))
+	}
+	return nil
+}
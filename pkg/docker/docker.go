@@ -1,36 +1,75 @@
 package docker
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os/exec"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mkuznets/classbox/pkg/api/models"
-	"github.com/pkg/errors"
+	"github.com/mkuznets/classbox/pkg/gotest"
 )
 
+const (
+	dataVolume = "classbox-data"
+	docsVolume = "classbox-docs"
+	// defaultTimeout is the unit test timeout for tests without one in meta
+	defaultTimeout = 5 * time.Second
+	// killSlack is how long a container may outlive its timeout before it is killed
+	killSlack = 5 * time.Second
+)
+
+// mount is a volume (or its subdirectory) mounted into a container
+type mount struct {
+	Volume  string
+	Target  string
+	Subpath string
+}
+
+// container describes a one-off container run
+type container struct {
+	Image       string
+	Cmd         []string
+	Env         []string
+	Mounts      []mount
+	NoNetwork   bool
+	SecurityOpt []string
+	Memory      uint64 // megabytes
+	Cpus        float64
+	Pids        uint64
+}
+
+// runtime starts containers and waits for them to exit. Containers must be
+// removed once the context is cancelled, in which case ctx.Err() is returned.
+type runtime interface {
+	run(ctx context.Context, c *container) (*Result, error)
+	pull(ctx context.Context, image string, auth *RegistryAuth) error
+}
+
+// Client is a Sandbox running the course images with a Docker runtime
 type Client struct {
 	BuilderImage string
 	RunnerImage  string
+	rt           runtime
 }
 
-type Result struct {
-	ExitCode int
-	Output   []byte
-	Stages   []*models.Stage
+// NewCLI returns a sandbox that runs containers with the docker CLI. Both the
+// CLI and the daemon have to be Docker 26 or newer for volume subpath mounts.
+func NewCLI(builderImage, runnerImage string) *Client {
+	return &Client{BuilderImage: builderImage, RunnerImage: runnerImage, rt: &cli{}}
 }
 
-func (r *Result) Success() bool {
-	return r.ExitCode == 0
+// NewEngine returns a sandbox that talks to the Docker Engine API directly.
+// Only unix socket hosts (unix:///var/run/docker.sock) are supported, and the
+// daemon has to be Docker 26 or newer (API 1.45) for volume subpath mounts.
+func NewEngine(host, builderImage, runnerImage string) *Client {
+	return &Client{BuilderImage: builderImage, RunnerImage: runnerImage, rt: newEngine(host)}
 }
 
-func (client *Client) runStaged(ctx context.Context, volumes map[string]string, args ...string) (*Result, error) {
-	r, err := client.run(ctx, volumes, args...)
+func (client *Client) runStaged(ctx context.Context, c *container) (*Result, error) {
+	r, err := client.run(ctx, c)
 	if err != nil {
 		return nil, err
 	}
@@ -41,69 +80,38 @@ func (client *Client) runStaged(ctx context.Context, volumes map[string]string,
 	return r, nil
 }
 
-func (client *Client) run(ctx context.Context, volumes map[string]string, args ...string) (*Result, error) {
-	cArgs := []string{"run", "--rm"}
-	for s, t := range volumes {
-		cArgs = append(cArgs, "-v", fmt.Sprintf("%s:%s", s, t))
-	}
-	cArgs = append(cArgs, args...)
-
-	log.Printf("[INFO] docker %v %v", volumes, strings.Join(Censor(args), " "))
-	cmd := exec.CommandContext(ctx, "docker", cArgs...)
-
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	err := cmd.Run()
-
-	var result Result
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			result.ExitCode = exitError.ExitCode()
-		} else {
-			return nil, err
-		}
-	}
-	result.Output = out.Bytes()
-	return &result, nil
-}
-
-func (client *Client) Login(ctx context.Context, username, password, host string) error {
-	cmd := exec.CommandContext(ctx, "docker", "login", "-u", username, "-p", password, host)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	err := cmd.Run()
-	if err != nil {
-		return errors.Wrap(err, out.String())
-	}
-	return nil
+func (client *Client) run(ctx context.Context, c *container) (*Result, error) {
+	log.Printf("[INFO] docker %s %s", c.Image, strings.Join(Censor(c.Cmd), " "))
+	return client.rt.run(ctx, c)
 }
 
-func (client *Client) PullImages(ctx context.Context) error {
+func (client *Client) PullImages(ctx context.Context, auth *RegistryAuth) error {
 	for _, image := range []string{client.BuilderImage, client.RunnerImage} {
-		cmd := exec.CommandContext(ctx, "docker", "pull", image)
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &out
-		err := cmd.Run()
-		if err != nil {
-			return errors.Wrap(err, out.String())
+		if err := client.rt.pull(ctx, image, auth); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 func (client *Client) BuildTests(ctx context.Context, url string) *Result {
-	r, err := client.runStaged(ctx, map[string]string{"classbox-data": "/out"}, client.BuilderImage, "build", "tests", url)
+	r, err := client.runStaged(ctx, &container{
+		Image:  client.BuilderImage,
+		Cmd:    []string{"build", "tests", url},
+		Mounts: []mount{{Volume: dataVolume, Target: "/out"}},
+	})
 	if err != nil {
-		return &Result{1, []byte("system error during build"), nil}
+		return &Result{ExitCode: 1, Output: []byte("system error during build")}
 	}
 	return r
 }
 
 func (client *Client) BuildBaseline(ctx context.Context) error {
-	r, err := client.run(ctx, map[string]string{"classbox-data": "/out"}, client.BuilderImage, "build", "baseline")
+	r, err := client.run(ctx, &container{
+		Image:  client.BuilderImage,
+		Cmd:    []string{"build", "baseline"},
+		Mounts: []mount{{Volume: dataVolume, Target: "/out"}},
+	})
 	if err != nil {
 		return err
 	}
@@ -114,7 +122,11 @@ func (client *Client) BuildBaseline(ctx context.Context) error {
 }
 
 func (client *Client) BuildDocs(ctx context.Context, webUrl string, docsUrl string) error {
-	r, err := client.run(ctx, map[string]string{"classbox-docs": "/out"}, client.BuilderImage, "build", "docs", "--web", webUrl, "--docs", docsUrl)
+	r, err := client.run(ctx, &container{
+		Image:  client.BuilderImage,
+		Cmd:    []string{"build", "docs", "--web", webUrl, "--docs", docsUrl},
+		Mounts: []mount{{Volume: docsVolume, Target: "/out"}},
+	})
 	if err != nil {
 		return err
 	}
@@ -125,7 +137,10 @@ func (client *Client) BuildDocs(ctx context.Context, webUrl string, docsUrl stri
 }
 
 func (client *Client) BuildMeta(ctx context.Context) ([]*models.Test, error) {
-	r, err := client.runStaged(ctx, nil, client.BuilderImage, "build", "meta")
+	r, err := client.runStaged(ctx, &container{
+		Image: client.BuilderImage,
+		Cmd:   []string{"build", "meta"},
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -147,68 +162,110 @@ func (client *Client) BuildMeta(ctx context.Context) ([]*models.Test, error) {
 	return meta, nil
 }
 
-func (client *Client) RunTest(ctx context.Context, test string, run *models.Run) error {
-	r, err := client.run(ctx, map[string]string{"classbox-data": "/in"},
-		"--network", "none",
-		"-e", "TIMEOUT=5", client.RunnerImage,
-		test+".test", "-test.v", "-test.run", "Unit",
-	)
+// testContainer returns a container running a test binary from the given
+// subdirectory of the data volume. The timeout is multiplied by scale for runs
+// that repeat the test.
+func (client *Client) testContainer(subdir string, limits *models.Limits, scale int, cmd ...string) (*container, time.Duration) {
+	timeout := defaultTimeout
+	if limits.Timeout > 0 {
+		timeout = time.Duration(limits.Timeout) * time.Second
+	}
+	timeout *= time.Duration(scale)
+
+	c := &container{
+		Image:     client.RunnerImage,
+		Cmd:       cmd,
+		Env:       []string{fmt.Sprintf("TIMEOUT=%d", int(timeout.Seconds()))},
+		Mounts:    []mount{{Volume: dataVolume, Target: "/in", Subpath: subdir}},
+		NoNetwork: true,
+		Memory:    limits.Memory,
+		Cpus:      limits.Cpus,
+		Pids:      limits.Pids,
+	}
+	return c, timeout
+}
+
+// runLimited runs a container and kills it if it outlives the timeout
+func (client *Client) runLimited(ctx context.Context, timeout time.Duration, c *container) (*Result, error) {
+	tctx, cancel := context.WithTimeout(ctx, timeout+killSlack)
+	defer cancel()
+
+	r, err := client.run(tctx, c)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return &Result{ExitCode: -1, TimedOut: true}, nil
+	}
+	return r, err
+}
+
+// setFailure fills the run with the outcome of an unsuccessful result
+func setFailure(run *models.Run, r *Result, timeout time.Duration) {
+	run.Status = r.Status()
+	switch run.Status {
+	case StatusTimeLimit:
+		run.Output = fmt.Sprintf("Time limit exceeded (%v)\n%s", timeout, r.Output)
+	case StatusMemoryLimit:
+		run.Output = fmt.Sprintf("Memory limit exceeded\n%s", r.Output)
+	default:
+		run.Output = string(r.Output)
+	}
+}
+
+func (client *Client) RunTest(ctx context.Context, subdir, test string, limits *models.Limits, run *models.Run) error {
+	c, timeout := client.testContainer(subdir, limits, 1, test+".test", "-test.v=test2json", "-test.run", "Unit")
+
+	r, err := client.runLimited(ctx, timeout, c)
 	if err != nil {
 		return err
 	}
+	run.Results = gotest.Parse(r.Output)
+	r.Output = gotest.Strip(r.Output)
 	if r.Success() {
 		run.Status = "success"
 	} else {
-		run.Status, run.Output = "failure", string(r.Output)
+		setFailure(run, r, timeout)
 	}
 	run.Test = test
 	return nil
 }
 
-func (client *Client) RunPerf(ctx context.Context, test string, run *models.Run) error {
+func (client *Client) RunPerf(ctx context.Context, subdir, test string, limits *models.Limits, policy *models.PerfPolicy, run *models.Run) error {
+	c, timeout := client.testContainer(subdir, limits, 2, test+".test", "-test.run", "Perf")
+	c.Env = append(c.Env, "GOGC=off")
 
-	r, err := client.run(ctx, map[string]string{"classbox-data": "/in"},
-		"--network", "none",
-		"-e", "TIMEOUT=10", "-e", "GOGC=off",
-		client.RunnerImage,
-		test+".test", "-test.run", "Perf",
-	)
+	r, err := client.runLimited(ctx, timeout, c)
 	if err != nil {
 		return err
 	}
 	if r.Success() {
 		run.Status = "success"
 	} else {
-		run.Status, run.Output = "failure", string(r.Output)
+		setFailure(run, r, timeout)
 		return nil
 	}
 
-	r, err = client.run(ctx, map[string]string{"classbox-data": "/in"},
-		"--security-opt", "seccomp=unconfined",
-		"--network", "none",
-		"-e", "TIMEOUT=20", "-e", "GOGC=off",
-		client.RunnerImage,
-		"perf", "stat", "-x", ";", "-r", "5",
-		test+".test", "-test.run", "Perf",
+	c, timeout = client.testContainer(subdir, limits, int(policy.Repetitions),
+		"sh", "-c", perfScript(test, policy),
 	)
+	c.Env = append(c.Env, "GOGC=off")
+	c.SecurityOpt = []string{"seccomp=unconfined"}
+
+	r, err = client.runLimited(ctx, timeout, c)
 	if err != nil {
 		return err
 	}
-
-	var perf uint64
-	for _, line := range strings.Split(string(r.Output), "\n") {
-		parts := strings.SplitN(line, ";", 3)
-		if len(parts) > 2 && strings.HasPrefix(parts[2], "cycles") {
-			if s, err := strconv.ParseUint(parts[0], 10, 64); err == nil {
-				perf = s
-			}
-		}
+	if status := r.Status(); status == StatusTimeLimit || status == StatusMemoryLimit {
+		setFailure(run, r, timeout)
+		return nil
 	}
-	if perf == 0 {
+
+	metrics := aggregateMetrics(parsePerf(r.Output), policy.Outliers)
+	score := metricScore(policy.Metric, metrics[policy.Metric])
+	if !r.Success() || score == 0 {
 		run.Status, run.Output = "failure", fmt.Sprintf("failed to run perf tests: %v", string(r.Output))
 		return nil
 	}
-	run.Score = perf
+	run.Score = score
+	run.Metrics = metrics
 	return nil
 }
 
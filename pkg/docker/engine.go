@@ -0,0 +1,280 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// engineVersion is the Docker Engine API version. Volume subpath mounts
+// require at least 1.45.
+const engineVersion = "v1.45"
+
+// removeTimeout limits removal of containers after their run is cancelled
+const removeTimeout = 30 * time.Second
+
+// engine runs containers through the Docker Engine API
+type engine struct {
+	http *http.Client
+}
+
+func newEngine(host string) *engine {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			if !strings.HasPrefix(host, "unix://") {
+				return nil, fmt.Errorf("unsupported docker host: %s", host)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", strings.TrimPrefix(host, "unix://"))
+		},
+	}
+	return &engine{http: &http.Client{Transport: transport}}
+}
+
+type engineError struct {
+	Message string `json:"message"`
+}
+
+func (e *engine) request(ctx context.Context, method, path string, query url.Values, header http.Header, body interface{}) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: "/" + engineVersion + path, RawQuery: query.Encode()}
+
+	var data io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		data = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var ee engineError
+		if err := json.NewDecoder(resp.Body).Decode(&ee); err != nil || ee.Message == "" {
+			return nil, fmt.Errorf("docker %s %s: %s", method, path, resp.Status)
+		}
+		return nil, fmt.Errorf("docker %s %s: %s", method, path, ee.Message)
+	}
+	return resp, nil
+}
+
+// call performs a request and decodes the JSON response into v, if not nil
+func (e *engine) call(ctx context.Context, method, path string, query url.Values, body, v interface{}) error {
+	resp, err := e.request(ctx, method, path, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
+
+type engineVolumeOptions struct {
+	Subpath string `json:"Subpath"`
+}
+
+type engineMount struct {
+	Type          string               `json:"Type"`
+	Source        string               `json:"Source"`
+	Target        string               `json:"Target"`
+	VolumeOptions *engineVolumeOptions `json:"VolumeOptions,omitempty"`
+}
+
+type engineHostConfig struct {
+	Mounts      []engineMount `json:"Mounts,omitempty"`
+	NetworkMode string        `json:"NetworkMode,omitempty"`
+	SecurityOpt []string      `json:"SecurityOpt,omitempty"`
+	Memory      int64         `json:"Memory,omitempty"`
+	MemorySwap  int64         `json:"MemorySwap,omitempty"`
+	NanoCpus    int64         `json:"NanoCpus,omitempty"`
+	PidsLimit   int64         `json:"PidsLimit,omitempty"`
+}
+
+type engineContainer struct {
+	Image      string           `json:"Image"`
+	Cmd        []string         `json:"Cmd"`
+	Env        []string         `json:"Env,omitempty"`
+	HostConfig engineHostConfig `json:"HostConfig"`
+}
+
+func (e *engine) run(ctx context.Context, c *container) (*Result, error) {
+	r, err := e.runContainer(ctx, c)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return r, err
+}
+
+func (e *engine) runContainer(ctx context.Context, c *container) (*Result, error) {
+	spec := engineContainer{
+		Image: c.Image,
+		Cmd:   c.Cmd,
+		Env:   c.Env,
+		HostConfig: engineHostConfig{
+			SecurityOpt: c.SecurityOpt,
+			Memory:      int64(c.Memory) << 20,
+			MemorySwap:  int64(c.Memory) << 20,
+			NanoCpus:    int64(c.Cpus * 1e9),
+			PidsLimit:   int64(c.Pids),
+		},
+	}
+	if c.NoNetwork {
+		spec.HostConfig.NetworkMode = "none"
+	}
+	for _, m := range c.Mounts {
+		em := engineMount{Type: "volume", Source: m.Volume, Target: m.Target}
+		if m.Subpath != "" {
+			em.VolumeOptions = &engineVolumeOptions{Subpath: m.Subpath}
+		}
+		spec.HostConfig.Mounts = append(spec.HostConfig.Mounts, em)
+	}
+
+	var created struct {
+		Id string `json:"Id"`
+	}
+	if err := e.call(ctx, "POST", "/containers/create", nil, &spec, &created); err != nil {
+		return nil, err
+	}
+	id := created.Id
+
+	defer func() {
+		// The run context may be already cancelled, the container must go anyway.
+		rctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+		defer cancel()
+		q := url.Values{"force": {"1"}}
+		if err := e.call(rctx, "DELETE", "/containers/"+id, q, nil, nil); err != nil {
+			log.Printf("[WARN] could not remove container %s: %v", id, err)
+		}
+	}()
+
+	if err := e.call(ctx, "POST", "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return nil, err
+	}
+
+	var wait struct {
+		StatusCode int `json:"StatusCode"`
+	}
+	if err := e.call(ctx, "POST", "/containers/"+id+"/wait", nil, nil, &wait); err != nil {
+		return nil, err
+	}
+
+	output, err := e.logs(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var inspect struct {
+		State struct {
+			OOMKilled bool `json:"OOMKilled"`
+		} `json:"State"`
+	}
+	if err := e.call(ctx, "GET", "/containers/"+id+"/json", nil, nil, &inspect); err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		ExitCode:  wait.StatusCode,
+		Output:    output,
+		OOMKilled: inspect.State.OOMKilled,
+	}, nil
+}
+
+// logs returns stdout and stderr of a container interleaved in the order of
+// writing.
+func (e *engine) logs(ctx context.Context, id string) ([]byte, error) {
+	q := url.Values{"stdout": {"1"}, "stderr": {"1"}}
+	resp, err := e.request(ctx, "GET", "/containers/"+id+"/logs", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return demux(resp.Body)
+}
+
+// demux strips stream headers from a multiplexed stdout/stderr stream:
+// each frame is prefixed with [stream, 0, 0, 0, size (big endian uint32)].
+func demux(r io.Reader) ([]byte, error) {
+	var (
+		out    bytes.Buffer
+		header [8]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return out.Bytes(), nil
+			}
+			return nil, errors.WithStack(err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(&out, r, size); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+}
+
+func (e *engine) pull(ctx context.Context, image string, auth *RegistryAuth) error {
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+
+	header := http.Header{}
+	if auth != nil {
+		b, err := json.Marshal(auth)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		header.Set("X-Registry-Auth", base64.URLEncoding.EncodeToString(b))
+	}
+
+	q := url.Values{"fromImage": {name}, "tag": {tag}}
+	resp, err := e.request(ctx, "POST", "/images/create", q, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Errors occurring after the pull has started are reported in the progress stream.
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err == nil && msg.Error != "" {
+			return fmt.Errorf("could not pull %s: %s", image, msg.Error)
+		}
+	}
+	return errors.WithStack(scanner.Err())
+}
@@ -0,0 +1,94 @@
+package docker
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+// repetitionMarker separates outputs of perf repetitions
+const repetitionMarker = "#repetition"
+
+// perfScript returns a shell script measuring perf tests of a test binary
+// the given number of times. Each repetition is measured separately, so that
+// outliers can be handled.
+func perfScript(test string, policy *models.PerfPolicy) string {
+	cmd := fmt.Sprintf("perf stat -x ';' -e %s,%s,%s", models.MetricCycles, models.MetricInstructions, models.MetricTaskClock)
+	if policy.Metric == models.MetricMaxRSS {
+		// GNU time, formatted as perf stat CSV output
+		cmd += fmt.Sprintf(" /usr/bin/time -f '%%M;KB;%s'", models.MetricMaxRSS)
+	}
+	cmd += fmt.Sprintf(" %s.test -test.run Perf", test)
+	return fmt.Sprintf("set -e; for i in $(seq %d); do echo '%s'; %s; done", policy.Repetitions, repetitionMarker, cmd)
+}
+
+// parsePerf returns metrics of each repetition from `perf stat -x ;` output
+func parsePerf(output []byte) []map[string]float64 {
+	var reps []map[string]float64
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) == repetitionMarker {
+			reps = append(reps, map[string]float64{})
+			continue
+		}
+		parts := strings.SplitN(line, ";", 4)
+		if len(reps) == 0 || len(parts) < 3 {
+			continue
+		}
+		// events may have modifiers, e.g. cycles:u
+		event := strings.SplitN(parts[2], ":", 2)[0]
+		if v, err := strconv.ParseFloat(parts[0], 64); err == nil {
+			reps[len(reps)-1][event] = v
+		}
+	}
+	return reps
+}
+
+// aggregateMetrics combines metrics of repetitions into a single value per
+// metric according to the outliers handling method.
+func aggregateMetrics(reps []map[string]float64, outliers string) map[string]float64 {
+	values := map[string][]float64{}
+	for _, rep := range reps {
+		for k, v := range rep {
+			values[k] = append(values[k], v)
+		}
+	}
+
+	metrics := make(map[string]float64, len(values))
+	for k, vs := range values {
+		sort.Float64s(vs)
+		switch {
+		case outliers == models.OutliersMedian:
+			if n := len(vs); n%2 == 1 {
+				metrics[k] = vs[n/2]
+			} else {
+				metrics[k] = (vs[n/2-1] + vs[n/2]) / 2
+			}
+		case outliers == models.OutliersTrimmed && len(vs) > 2:
+			metrics[k] = mean(vs[1 : len(vs)-1])
+		default:
+			metrics[k] = mean(vs)
+		}
+	}
+	return metrics
+}
+
+func mean(vs []float64) float64 {
+	var sum float64
+	for _, v := range vs {
+		sum += v
+	}
+	return sum / float64(len(vs))
+}
+
+// metricScore converts a metric value into an integer run score.
+// Task clock is scored in microseconds to keep the precision.
+func metricScore(metric string, value float64) uint64 {
+	if metric == models.MetricTaskClock {
+		value *= 1000
+	}
+	return uint64(math.Round(value))
+}
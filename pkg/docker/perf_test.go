@@ -0,0 +1,82 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+const perfOutput = `#repetition
+ok  	heap	0.012s
+1200;;cycles:u;10023451;100.00;;
+900;;instructions:u;10023451;100.00;0.75;insn per cycle
+2.50;msec;task-clock:u;2500120;100.00;0.912;CPUs utilized
+5120;KB;max-rss
+#repetition
+1000;;cycles:u;10023451;100.00;;
+<not supported>;;instructions:u;0;100.00;;
+1.50;msec;task-clock:u;1500120;100.00;0.912;CPUs utilized
+#repetition
+1400;;cycles;10023451;100.00;;
+2.00;msec;task-clock;2000120;100.00;0.912;CPUs utilized
+`
+
+func TestParsePerf(t *testing.T) {
+	expected := []map[string]float64{
+		{models.MetricCycles: 1200, models.MetricInstructions: 900, models.MetricTaskClock: 2.5, models.MetricMaxRSS: 5120},
+		{models.MetricCycles: 1000, models.MetricTaskClock: 1.5},
+		{models.MetricCycles: 1400, models.MetricTaskClock: 2},
+	}
+	if reps := parsePerf([]byte(perfOutput)); !reflect.DeepEqual(reps, expected) {
+		t.Errorf("expected %v, got %v", expected, reps)
+	}
+
+	if reps := parsePerf([]byte("1200;;cycles;1;100.00;;\n")); len(reps) != 0 {
+		t.Errorf("expected no repetitions without markers, got %v", reps)
+	}
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	reps := parsePerf([]byte(perfOutput))
+
+	cases := []struct {
+		outliers string
+		cycles   float64
+	}{
+		{models.OutliersNone, 1200},
+		{models.OutliersMedian, 1200},
+		{models.OutliersTrimmed, 1200},
+	}
+	for _, c := range cases {
+		metrics := aggregateMetrics(reps, c.outliers)
+		if metrics[models.MetricCycles] != c.cycles {
+			t.Errorf("%s: expected %v cycles, got %v", c.outliers, c.cycles, metrics[models.MetricCycles])
+		}
+	}
+
+	// metrics missing in some repetitions are aggregated over the others
+	if v := aggregateMetrics(reps, models.OutliersNone)[models.MetricInstructions]; v != 900 {
+		t.Errorf("expected 900 instructions, got %v", v)
+	}
+
+	skewed := []map[string]float64{{"x": 1}, {"x": 2}, {"x": 3}, {"x": 100}}
+	for outliers, expected := range map[string]float64{
+		models.OutliersNone:    26.5,
+		models.OutliersMedian:  2.5,
+		models.OutliersTrimmed: 2.5,
+	} {
+		if v := aggregateMetrics(skewed, outliers)["x"]; v != expected {
+			t.Errorf("%s: expected %v, got %v", outliers, expected, v)
+		}
+	}
+}
+
+func TestMetricScore(t *testing.T) {
+	if s := metricScore(models.MetricCycles, 1234.6); s != 1235 {
+		t.Errorf("expected 1235, got %d", s)
+	}
+	if s := metricScore(models.MetricTaskClock, 2.5004); s != 2500 {
+		t.Errorf("expected task clock in microseconds, got %d", s)
+	}
+}
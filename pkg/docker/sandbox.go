@@ -0,0 +1,63 @@
+package docker
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+const (
+	StatusTimeLimit   = "time_limit_exceeded"
+	StatusMemoryLimit = "memory_limit_exceeded"
+)
+
+// Sandbox builds and runs untrusted code in isolated containers
+type Sandbox interface {
+	BuildTests(ctx context.Context, url string) *Result
+	BuildMeta(ctx context.Context) ([]*models.Test, error)
+	BuildDocs(ctx context.Context, webUrl string, docsUrl string) error
+	BuildBaseline(ctx context.Context) error
+	RunTest(ctx context.Context, subdir, test string, limits *models.Limits, run *models.Run) error
+	RunPerf(ctx context.Context, subdir, test string, limits *models.Limits, policy *models.PerfPolicy, run *models.Run) error
+}
+
+// Puller is implemented by sandboxes that can update the course images
+type Puller interface {
+	PullImages(ctx context.Context, auth *RegistryAuth) error
+}
+
+// RegistryAuth contains credentials of a private images registry
+type RegistryAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Host     string `json:"serveraddress"`
+}
+
+type Result struct {
+	ExitCode  int
+	Output    []byte
+	Stages    []*models.Stage
+	TimedOut  bool
+	OOMKilled bool
+}
+
+func (r *Result) Success() bool {
+	return r.ExitCode == 0 && !r.TimedOut
+}
+
+// Status returns the outcome of a test run, telling limit violations apart
+// from ordinary failures.
+func (r *Result) Status() string {
+	out := string(r.Output)
+	switch {
+	case r.Success():
+		return "success"
+	case r.TimedOut, r.ExitCode == 124, strings.Contains(out, "panic: test timed out after"):
+		return StatusTimeLimit
+	case r.OOMKilled, r.ExitCode == 137, strings.Contains(out, "runtime: out of memory"):
+		return StatusMemoryLimit
+	default:
+		return "failure"
+	}
+}
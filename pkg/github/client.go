@@ -6,7 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
@@ -14,6 +18,11 @@ import (
 
 const (
 	baseUrl = "https://api.github.com"
+
+	// Requests hitting the rate limit are retried if the limit resets
+	// soon enough, otherwise the error is returned.
+	maxRateLimitWait    = time.Minute
+	maxRateLimitRetries = 3
 )
 
 type Client struct {
@@ -41,6 +50,34 @@ func (e *ErrorResponse) NotFound() bool {
 	return e.Response.StatusCode == http.StatusNotFound
 }
 
+// RateLimited reports whether the request was rejected by the primary or
+// the secondary rate limit
+func (e *ErrorResponse) RateLimited() bool {
+	_, ok := rateLimitWait(e.Response)
+	return ok
+}
+
+// rateLimitWait returns how long to wait before retrying a request rejected
+// by a rate limit
+func rateLimitWait(r *http.Response) (time.Duration, bool) {
+	if r.StatusCode != http.StatusForbidden && r.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if v := r.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if r.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(r.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return maxRateLimitWait, true
+		}
+		return time.Until(time.Unix(reset, 0)) + time.Second, true
+	}
+	return 0, false
+}
+
 func checkResponse(r *http.Response) error {
 	if c := r.StatusCode; 200 <= c && c <= 299 {
 		return nil
@@ -56,14 +93,38 @@ func checkResponse(r *http.Response) error {
 	return e
 }
 
+// Request sends an API request. Requests rejected by a rate limit are
+// retried after the limit resets unless it takes longer than a minute.
 func (c *Client) Request(ctx context.Context, method string, path string, body []byte, acceptHeader string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		data, resp, err := c.request(ctx, method, path, body, acceptHeader)
+		if err == nil {
+			return data, nil
+		}
+		if resp == nil || attempt >= maxRateLimitRetries {
+			return nil, err
+		}
+		wait, ok := rateLimitWait(resp)
+		if !ok || wait > maxRateLimitWait {
+			return nil, err
+		}
+		log.Printf("[WARN] Github rate limit exceeded, retrying %s %s in %v", method, path, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+func (c *Client) request(ctx context.Context, method string, path string, body []byte, acceptHeader string) ([]byte, *http.Response, error) {
 
 	url := fmt.Sprintf(baseUrl + path)
 	buf := bytes.NewBuffer(body)
 
 	req, err := http.NewRequestWithContext(ctx, method, url, buf)
 	if err != nil {
-		return nil, errors.WithMessage(err, "could not create Request")
+		return nil, nil, errors.WithMessage(err, "could not create Request")
 	}
 	c.token.SetAuthHeader(req)
 
@@ -75,7 +136,7 @@ func (c *Client) Request(ctx context.Context, method string, path string, body [
 
 	resp, err := c.http.Do(req)
 	if err != nil {
-		return nil, errors.WithMessage(err, "could not send Request")
+		return nil, nil, errors.WithMessage(err, "could not send Request")
 	}
 
 	//noinspection GoUnhandledErrorResult
@@ -83,14 +144,14 @@ func (c *Client) Request(ctx context.Context, method string, path string, body [
 
 	if err := checkResponse(resp); err != nil {
 		// return nil, errors.WithMessagef(err, "HTTP error on %s %s", method, path)
-		return nil, err
+		return nil, resp, err
 	}
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.WithMessage(err, "could not read the response")
+		return nil, nil, errors.WithMessage(err, "could not read the response")
 	}
-	return data, nil
+	return data, resp, nil
 }
 
 func (c *Client) RevokeOAuth(ctx context.Context, clientID, clientSecret string) error {
@@ -266,8 +327,17 @@ func (c *Client) CreateRepoFromTemplate(ctx context.Context, src, dst string, is
 	return &repo, nil
 }
 
+// Limits of check run outputs imposed by Github
+const (
+	MaxSummary     = 65535 // characters of the output summary
+	MaxAnnotations = 50    // annotations per request
+)
+
+// CreateCheckRun creates a check run. Annotations beyond the first
+// MaxAnnotations are added by subsequent updates.
 func (c *Client) CreateCheckRun(ctx context.Context, login, repo string, checkRun *CheckRun) (*CheckRun, error) {
-	body, err := json.Marshal(&checkRun)
+	first, rest := splitAnnotations(checkRun)
+	body, err := json.Marshal(first)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -283,14 +353,19 @@ func (c *Client) CreateCheckRun(ctx context.Context, login, repo string, checkRu
 	if err != nil {
 		return nil, errors.Wrap(err, "could not decode response")
 	}
+	if err := c.annotateCheckRun(ctx, login, repo, cr.ID, first.Output, rest); err != nil {
+		return nil, err
+	}
 	return &cr, nil
 }
 
+// UpdateCheckRun updates a check run. Annotations beyond the first
+// MaxAnnotations are added by subsequent updates.
 func (c *Client) UpdateCheckRun(ctx context.Context, login, repo string, checkRun *CheckRun) error {
-	cr := *checkRun
+	cr, rest := splitAnnotations(checkRun)
 	id := cr.ID
 	cr.ID = 0
-	body, err := json.Marshal(&cr)
+	body, err := json.Marshal(cr)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -300,6 +375,99 @@ func (c *Client) UpdateCheckRun(ctx context.Context, login, repo string, checkRu
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	return c.annotateCheckRun(ctx, login, repo, id, cr.Output, rest)
+}
+
+// CreateCheckRuns creates several check runs one by one, as Github
+// recommends serial requests to avoid secondary rate limits. The check runs
+// created before an error are returned along with it.
+func (c *Client) CreateCheckRuns(ctx context.Context, login, repo string, checkRuns []*CheckRun) ([]*CheckRun, error) {
+	created := make([]*CheckRun, 0, len(checkRuns))
+	for _, checkRun := range checkRuns {
+		cr, err := c.CreateCheckRun(ctx, login, repo, checkRun)
+		if err != nil {
+			return created, errors.Wrapf(err, "could not create check run `%s`", checkRun.Name)
+		}
+		created = append(created, cr)
+	}
+	return created, nil
+}
+
+// annotateCheckRun adds batches of annotations to the check run, Github
+// appends them to the ones already added.
+func (c *Client) annotateCheckRun(ctx context.Context, login, repo string, id uint64, output *CheckRunOutput, batches [][]*Annotation) error {
+	path := fmt.Sprintf("/repos/%s/%s/check-runs/%d", login, repo, id)
+	for _, batch := range batches {
+		out := *output
+		out.Annotations = batch
+		body, err := json.Marshal(&CheckRun{Output: &out})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = c.Request(ctx, "PATCH", path, body, "application/vnd.github.antiope-preview+json")
+		if err != nil {
+			return errors.Wrap(err, "could not add annotations")
+		}
+	}
+	return nil
+}
+
+// truncateSummary cuts the markdown summary at a line boundary to fit
+// MaxSummary and closes a code block left open by the cut. Bytes are
+// counted, so the result is within the limit in characters too.
+func truncateSummary(summary string) string {
+	if len(summary) <= MaxSummary {
+		return summary
+	}
+	const note = "\n\n*The summary is truncated, see the full report.*"
+	cut := summary[:MaxSummary-len(note)-len("\n```")]
+	if i := strings.LastIndexByte(cut, '\n'); i >= 0 {
+		cut = cut[:i]
+	}
+	if strings.Count(cut, "```")%2 == 1 {
+		cut += "\n```"
+	}
+	return cut + note
+}
+
+// splitAnnotations returns a copy of the check run with the summary cut to
+// MaxSummary and at most MaxAnnotations annotations, the remaining ones are
+// returned in batches.
+func splitAnnotations(checkRun *CheckRun) (*CheckRun, [][]*Annotation) {
+	cr := *checkRun
+	if cr.Output == nil {
+		return &cr, nil
+	}
+	out := *cr.Output
+	cr.Output = &out
+
+	out.Summary = truncateSummary(out.Summary)
+
+	all := out.Annotations
+	if len(all) <= MaxAnnotations {
+		return &cr, nil
+	}
+	out.Annotations = all[:MaxAnnotations]
+	var batches [][]*Annotation
+	for i := MaxAnnotations; i < len(all); i += MaxAnnotations {
+		end := i + MaxAnnotations
+		if end > len(all) {
+			end = len(all)
+		}
+		batches = append(batches, all[i:end])
+	}
+	return &cr, batches
+}
+
+func (c *Client) CreateReview(ctx context.Context, login, repo string, number int, review *Review) error {
+	body, err := json.Marshal(review)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path := fmt.Sprintf("/repos/%s/%s/pulls/%d/reviews", login, repo, number)
+	if _, err := c.Request(ctx, "POST", path, body, ""); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -311,3 +479,23 @@ func (c *Client) Archive(ctx context.Context, login, repo, commit string) ([]byt
 	}
 	return data, nil
 }
+
+// Files returns paths of all files in the tree of the commit
+func (c *Client) Files(ctx context.Context, login, repo, commit string) ([]string, error) {
+	path := fmt.Sprintf("/repos/%s/%s/git/trees/%s?recursive=1", login, repo, commit)
+	data, err := c.Request(ctx, "GET", path, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, errors.Wrap(err, "could not decode response")
+	}
+	var files []string
+	for _, e := range tree.Entries {
+		if e.Type == "blob" {
+			files = append(files, e.Path)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,53 @@
+package github
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitAnnotations(t *testing.T) {
+	cr := &CheckRun{ID: 1, Output: &CheckRunOutput{Title: "Failed", Summary: "summary"}}
+	for i := 0; i < 2*MaxAnnotations+1; i++ {
+		cr.Output.Annotations = append(cr.Output.Annotations, &Annotation{StartLine: i})
+	}
+
+	first, batches := splitAnnotations(cr)
+	if len(first.Output.Annotations) != MaxAnnotations {
+		t.Fatalf("expected %d annotations in the first request, got %d", MaxAnnotations, len(first.Output.Annotations))
+	}
+	if len(batches) != 2 || len(batches[0]) != MaxAnnotations || len(batches[1]) != 1 {
+		t.Fatalf("unexpected batches: %d", len(batches))
+	}
+	if batches[1][0].StartLine != 2*MaxAnnotations {
+		t.Fatalf("annotations are out of order")
+	}
+	if len(cr.Output.Annotations) != 2*MaxAnnotations+1 {
+		t.Fatalf("the original check run is modified")
+	}
+
+	few := &CheckRun{Output: &CheckRunOutput{Annotations: []*Annotation{{}}}}
+	if first, batches := splitAnnotations(few); len(first.Output.Annotations) != 1 || batches != nil {
+		t.Fatalf("unexpected split of a single annotation")
+	}
+}
+
+func TestTruncateSummary(t *testing.T) {
+	if s := truncateSummary("short"); s != "short" {
+		t.Fatalf("expected the summary intact, got %q", s)
+	}
+
+	line := strings.Repeat("x", 99) + "\n"
+	summary := "* `test`\n  ```text\n" + strings.Repeat(line, MaxSummary/len(line)+10)
+	s := truncateSummary(summary)
+	if len(s) > MaxSummary {
+		t.Fatalf("summary is too long: %d", len(s))
+	}
+	body := s[:strings.LastIndex(s, "\n\n")]
+	if !strings.HasSuffix(body, "\n```") {
+		t.Fatalf("code block is not closed: %q", body[len(body)-20:])
+	}
+	lines := strings.Split(strings.TrimSuffix(body, "\n```"), "\n")
+	if last := lines[len(lines)-1]; last != strings.TrimSuffix(line, "\n") {
+		t.Fatalf("summary is cut in the middle of a line: %q", last)
+	}
+}
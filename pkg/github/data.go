@@ -35,6 +35,53 @@ type CheckSuite struct {
 	Head string `json:"head_sha"`
 }
 
+type CheckRunEvent struct {
+	CheckRun *CheckRun     `json:"check_run"`
+	Action   string        `json:"action"`
+	Repo     *Repo         `json:"repository"`
+	Sender   *User         `json:"sender"`
+	Inst     *Installation `json:"installation"`
+}
+
+type PushEvent struct {
+	Ref     string        `json:"ref"`
+	After   string        `json:"after"`
+	Deleted bool          `json:"deleted"`
+	Repo    *Repo         `json:"repository"`
+	Sender  *User         `json:"sender"`
+	Inst    *Installation `json:"installation"`
+}
+
+type PullRequestEvent struct {
+	Action      string        `json:"action"`
+	Number      int           `json:"number"`
+	PullRequest *PullRequest  `json:"pull_request"`
+	Repo        *Repo         `json:"repository"`
+	Sender      *User         `json:"sender"`
+	Inst        *Installation `json:"installation"`
+}
+
+type PullRequest struct {
+	Number int     `json:"number"`
+	Url    string  `json:"html_url"`
+	Head   *Branch `json:"head"`
+	Base   *Branch `json:"base"`
+}
+
+type Branch struct {
+	Ref  string `json:"ref"`
+	Sha  string `json:"sha"`
+	Repo *Repo  `json:"repo"`
+}
+
+// Review is a pull request review, Event is one of APPROVE, REQUEST_CHANGES
+// or COMMENT
+type Review struct {
+	Commit string `json:"commit_id,omitempty"`
+	Body   string `json:"body"`
+	Event  string `json:"event"`
+}
+
 type CheckRun struct {
 	ID             uint64          `json:"id,omitempty"`
 	Name           string          `json:"name,omitempty"`
@@ -48,8 +95,31 @@ type CheckRun struct {
 }
 
 type CheckRunOutput struct {
-	Title   string `json:"title"`
-	Summary string `json:"summary"`
+	Title       string        `json:"title"`
+	Summary     string        `json:"summary"`
+	Annotations []*Annotation `json:"annotations,omitempty"`
+}
+
+// Annotation marks a line of a file in the commit, Level is one of notice,
+// warning or failure
+type Annotation struct {
+	Path        string `json:"path"`
+	StartLine   int    `json:"start_line"`
+	EndLine     int    `json:"end_line"`
+	StartColumn int    `json:"start_column,omitempty"`
+	EndColumn   int    `json:"end_column,omitempty"`
+	Level       string `json:"annotation_level"`
+	Title       string `json:"title,omitempty"`
+	Message     string `json:"message"`
+}
+
+// Tree is a git tree, Type of entries is "blob" for files
+type Tree struct {
+	Entries []*struct {
+		Path string `json:"path"`
+		Type string `json:"type"`
+	} `json:"tree"`
+	Truncated bool `json:"truncated"`
 }
 
 type AccessToken struct {
@@ -0,0 +1,92 @@
+// Package gotest parses verbose output of Go test binaries run with
+// -test.v=test2json into per-(sub)test results.
+package gotest
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+// marker prefixes framing lines in -test.v=test2json output
+const marker = "\x16"
+
+var (
+	startRe  = regexp.MustCompile(`^=== (?:RUN|NAME|CONT|PAUSE)\s+(\S+)`)
+	resultRe = regexp.MustCompile(`^--- (PASS|FAIL|SKIP): (\S+) \(([0-9.]+)s\)`)
+)
+
+// Strip removes framing markers, leaving the plain verbose output
+func Strip(output []byte) []byte {
+	return bytes.Replace(output, []byte(marker), nil, -1)
+}
+
+// Parse returns results of all tests and subtests found in the output in
+// the order they were started. Tests that never reported a result (e.g.
+// because of a panic or a timeout) are considered failed.
+func Parse(output []byte) []*models.TestResult {
+	var (
+		results []*models.TestResult
+		byName  = map[string]*models.TestResult{}
+		outputs = map[string]*strings.Builder{}
+		current string
+	)
+
+	get := func(name string) *models.TestResult {
+		if r, ok := byName[name]; ok {
+			return r
+		}
+		r := &models.TestResult{Name: name}
+		byName[name] = r
+		outputs[name] = &strings.Builder{}
+		results = append(results, r)
+		return r
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, "\r")
+		framing := strings.TrimSpace(strings.Replace(line, marker, "", -1))
+
+		if m := startRe.FindStringSubmatch(framing); m != nil {
+			current = get(m[1]).Name
+			continue
+		}
+		if m := resultRe.FindStringSubmatch(framing); m != nil {
+			r := get(m[2])
+			r.Status = strings.ToLower(m[1])
+			r.Elapsed, _ = strconv.ParseFloat(m[3], 64)
+			// non-chatty output of a test follows its result line
+			current = r.Name
+			continue
+		}
+
+		switch {
+		case current == "", framing == "":
+			continue
+		case framing == "PASS" || framing == "FAIL" || strings.HasPrefix(framing, "exit status"):
+			current = ""
+			continue
+		}
+
+		// Messages are indented by 4 spaces, or by 4 spaces per nesting level
+		// when a subtest output is flushed to its parent.
+		indent := strings.Repeat(" ", 4*(strings.Count(current, "/")+1))
+		if !strings.HasPrefix(line, indent) {
+			indent = "    "
+		}
+		b := outputs[current]
+		b.WriteString(strings.TrimPrefix(line, indent))
+		b.WriteByte('\n')
+	}
+
+	for _, r := range results {
+		if r.Status == "" {
+			r.Status = "fail"
+		}
+		r.Output = strings.TrimRight(outputs[r.Name].String(), "\n")
+	}
+	return results
+}
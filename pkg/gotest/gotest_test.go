@@ -0,0 +1,45 @@
+package gotest_test
+
+import (
+	"testing"
+
+	"github.com/mkuznets/classbox/pkg/gotest"
+)
+
+const output = "\x16=== RUN   TestUnit\n" +
+	"\x16=== RUN   TestUnit/empty\n" +
+	"\x16=== RUN   TestUnit/large\n" +
+	"    heap_test.go:42: expected 3, got 4\n" +
+	"\x16=== RUN   TestUnit/unicode\n" +
+	"    heap_test.go:50: not implemented\n" +
+	"\x16--- PASS: TestUnit/empty (0.00s)\n" +
+	"\x16--- FAIL: TestUnit/large (0.25s)\n" +
+	"\x16--- SKIP: TestUnit/unicode (0.00s)\n" +
+	"\x16--- FAIL: TestUnit (0.25s)\n" +
+	"\x16=== RUN   TestUnitPanic\n" +
+	"panic: runtime error: index out of range [recovered]\n" +
+	"FAIL\n"
+
+func TestParse(t *testing.T) {
+	results := gotest.Parse([]byte(output))
+
+	expected := []struct {
+		name, status, output string
+		elapsed              float64
+	}{
+		{"TestUnit", "fail", "", 0.25},
+		{"TestUnit/empty", "pass", "", 0},
+		{"TestUnit/large", "fail", "heap_test.go:42: expected 3, got 4", 0.25},
+		{"TestUnit/unicode", "skip", "heap_test.go:50: not implemented", 0},
+		{"TestUnitPanic", "fail", "panic: runtime error: index out of range [recovered]", 0},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, e := range expected {
+		r := results[i]
+		if r.Name != e.name || r.Status != e.status || r.Output != e.output || r.Elapsed != e.elapsed {
+			t.Fatalf("expected %+v, got %+v", e, *r)
+		}
+	}
+}
@@ -6,18 +6,26 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 )
 
-// AWS contains credentials and parameters for AWS APIs (particularly, S3)
+// AWS contains credentials and parameters for AWS APIs (particularly, S3).
+// Endpoint and PathStyle allow using S3-compatible storages.
 type AWS struct {
-	Region    string `long:"region" env:"REGION" description:"region id" required:"true"`
-	KeyID     string `long:"access-key-id" env:"ACCESS_KEY_ID" description:"access id" required:"true"`
-	SecretKey string `long:"secret-access-key" env:"SECRET_ACCESS_KEY" description:"access secret" required:"true"`
-	Bucket    string `long:"s3-bucket" env:"S3_BUCKET" description:"S3 bucket name" required:"true"`
+	Region    string `long:"region" env:"REGION" description:"region id"`
+	KeyID     string `long:"access-key-id" env:"ACCESS_KEY_ID" description:"access id"`
+	SecretKey string `long:"secret-access-key" env:"SECRET_ACCESS_KEY" description:"access secret"`
+	Bucket    string `long:"s3-bucket" env:"S3_BUCKET" description:"S3 bucket name"`
+	Endpoint  string `long:"s3-endpoint" env:"S3_ENDPOINT" description:"endpoint of S3-compatible storage"`
+	PathStyle bool   `long:"s3-path-style" env:"S3_PATH_STYLE" description:"use path-style S3 URLs"`
 }
 
 // Session returns AWS SDK session based on the given credentials
 func (a *AWS) Session() *session.Session {
-	return session.Must(session.NewSession(&aws.Config{
-		Region:      aws.String(a.Region),
-		Credentials: credentials.NewStaticCredentials(a.KeyID, a.SecretKey, ""),
-	}))
+	config := &aws.Config{
+		Region:           aws.String(a.Region),
+		Credentials:      credentials.NewStaticCredentials(a.KeyID, a.SecretKey, ""),
+		S3ForcePathStyle: aws.Bool(a.PathStyle),
+	}
+	if a.Endpoint != "" {
+		config.Endpoint = aws.String(a.Endpoint)
+	}
+	return session.Must(session.NewSession(config))
 }
@@ -1,6 +1,8 @@
 package opts
 
 type Docker struct {
+	Backend      string `long:"backend" env:"BACKEND" description:"sandbox backend, both require Docker 26 or newer" choice:"engine" choice:"cli" default:"cli"` // nolint
+	Host         string `long:"host" env:"HOST" description:"Docker Engine API socket" default:"unix:///var/run/docker.sock"`
 	Pull         bool   `long:"pull" env:"PULL" description:"pull course images"`
 	Login        bool   `long:"login" env:"LOGIN" description:"log in before pulling the images"`
 	Repo         *Repo  `group:"Docker Images Repository" namespace:"repo"  env-namespace:"REPO"`
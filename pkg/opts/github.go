@@ -36,12 +36,13 @@ func (g *OAuth) Config() *oauth2.Config {
 
 // App contains settings of (native) Github App
 type App struct {
-	ID           string `long:"id" env:"ID" description:"app id" required:"true"`
-	ClientID     string `long:"client-id" env:"CLIENT_ID" description:"client id" required:"true"`
-	ClientSecret string `long:"client-secret" env:"CLIENT_SECRET" description:"client secret" required:"true"`
-	Name         string `long:"name" env:"NAME" description:"app name" required:"true"`
-	HookSecret   string `long:"hook-secret" env:"HOOK_SECRET" required:"true"`
-	PrivateKey   string `long:"private-key" env:"PRIVATE_KEY" description:"base64-encoded private key in pem format" required:"true"`
+	ID           string   `long:"id" env:"ID" description:"app id" required:"true"`
+	ClientID     string   `long:"client-id" env:"CLIENT_ID" description:"client id" required:"true"`
+	ClientSecret string   `long:"client-secret" env:"CLIENT_SECRET" description:"client secret" required:"true"`
+	Name         string   `long:"name" env:"NAME" description:"app name" required:"true"`
+	HookSecrets  []string `long:"hook-secret" env:"HOOK_SECRET" env-delim:"," description:"webhook secrets, several comma-separated ones are accepted while the secret is rotated (secrets cannot contain commas)" required:"true"`
+	HookSHA1     bool     `long:"hook-sha1" env:"HOOK_SHA1" description:"accept legacy HMAC-SHA1 signatures of webhooks without a SHA-256 one"`
+	PrivateKey   string   `long:"private-key" env:"PRIVATE_KEY" description:"base64-encoded private key in pem format" required:"true"`
 }
 
 // Config returns `oauth2.Config` for the given settings
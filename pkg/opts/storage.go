@@ -0,0 +1,11 @@
+package opts
+
+// Storage selects where repository archives and logs are kept. The local
+// directory has to be shared by the API and runners, its files are served
+// by the API.
+type Storage struct {
+	Backend string `long:"backend" env:"BACKEND" description:"object storage backend" choice:"s3" choice:"local" default:"s3"` // nolint
+	Dir     string `long:"dir" env:"DIR" description:"directory of the local storage"`
+	URL     string `long:"url" env:"URL" description:"public API URL serving the local storage"`
+	Secret  string `long:"secret" env:"SECRET" description:"key signing URLs of the local storage"`
+}
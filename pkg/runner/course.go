@@ -1,9 +1,11 @@
 package runner
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/docker"
 	"github.com/mkuznets/classbox/pkg/fileutils"
 	"github.com/pkg/errors"
 )
@@ -14,16 +16,18 @@ func (rr *Runner) upgradeCourse() error {
 	dcl := rr.dockerClient()
 
 	if rr.Docker.Pull {
+		puller, ok := dcl.(docker.Puller)
+		if !ok {
+			return errors.New("sandbox backend cannot pull images")
+		}
 		log.Print("[INFO] Pulling images...")
+		var auth *docker.RegistryAuth
 		if rr.Docker.Login {
 			repo := rr.Docker.Repo
-			log.Printf("[INFO] `docker login` for %s", repo.Host)
-			if err := dcl.Login(rr.Ctx, repo.Username, repo.Password, repo.Host); err != nil {
-				return errors.Wrap(err, "could not login")
-			}
+			log.Printf("[INFO] using credentials for %s", repo.Host)
+			auth = &docker.RegistryAuth{Username: repo.Username, Password: repo.Password, Host: repo.Host}
 		}
-		log.Printf("[INFO] `docker pull`")
-		if err := dcl.PullImages(rr.Ctx); err != nil {
+		if err := puller.PullImages(rr.Ctx, auth); err != nil {
 			return errors.Wrap(err, "could not pull images")
 		}
 		log.Printf("[INFO] Images updated")
@@ -38,7 +42,8 @@ func (rr *Runner) upgradeCourse() error {
 		return errors.Wrap(err, "could not save meta")
 	}
 
-	if err := dcl.BuildDocs(rr.Ctx, rr.WebURL, rr.DocsURL); err != nil {
+	webURL := fmt.Sprintf("%s/%s", rr.WebURL, rr.Course)
+	if err := dcl.BuildDocs(rr.Ctx, webURL, rr.DocsURL); err != nil {
 		return errors.WithStack(err)
 	}
 
@@ -50,10 +55,13 @@ func (rr *Runner) upgradeCourse() error {
 		return errors.WithStack(err)
 	}
 
-	store, err := rr.newStore("upgrade", true)
+	store, err := rr.newStore(rr.Ctx, "upgrade", true)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	store.onComplete = func(a *Artifact) {
+		rr.keepRunLog(rr.Ctx, a)
+	}
 
 	err = store.Execute(rr.Ctx)
 	if err != nil {
@@ -75,7 +83,7 @@ func (rr *Runner) upgradeCourse() error {
 		return errors.WithStack(err)
 	}
 
-	if err := api.UpdateCourse(rr.Ctx, true); err != nil {
+	if err := api.UpdateCourse(rr.Ctx, true, rr.Regrade); err != nil {
 		return errors.WithStack(err)
 	}
 
@@ -0,0 +1,51 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mkuznets/classbox/pkg/utils"
+)
+
+// minResultOutput is the least output kept for each subtest, however many
+// subtests the run has
+const minResultOutput = 512
+
+// keepLog truncates the output to MaxOutput bytes and uploads the full one to
+// the blob store under the given name. It returns the blob key, or an empty
+// string if the output has not been truncated or could not be uploaded.
+func (rr *Runner) keepLog(ctx context.Context, name string, output *string) string {
+	if rr.MaxOutput <= 0 || len(*output) <= rr.MaxOutput {
+		return ""
+	}
+	full := *output
+	*output = utils.Truncate(full, rr.MaxOutput)
+
+	key := fmt.Sprintf("%s/%s/logs/%s.log", rr.Env.Type, rr.Course, name)
+	if err := rr.Blobs.Upload(ctx, key, strings.NewReader(full)); err != nil {
+		log.Printf("[WARN] could not upload log %s: %v", key, err)
+		return ""
+	}
+	return key
+}
+
+// keepRunLog truncates the output of the artifact's run. The runs are cached
+// by hash, so are their logs. Outputs of subtests are parts of the run output,
+// so they are truncated to share MaxOutput and are kept in the full log.
+func (rr *Runner) keepRunLog(ctx context.Context, a *Artifact) {
+	if key := rr.keepLog(ctx, "runs/"+a.Run.Hash, &a.Run.Output); key != "" {
+		a.Run.LogKey = key
+	}
+	if rr.MaxOutput <= 0 || len(a.Run.Results) == 0 {
+		return
+	}
+	limit := rr.MaxOutput / len(a.Run.Results)
+	if limit < minResultOutput {
+		limit = minResultOutput
+	}
+	for _, r := range a.Run.Results {
+		r.Output = utils.Truncate(r.Output, limit)
+	}
+}
@@ -0,0 +1,75 @@
+package runner
+
+import (
+	"context"
+	"log"
+
+	"github.com/mkuznets/classbox/pkg/api/client"
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+// progressBuffer is the number of stages waiting to be reported, stages
+// beyond it are dropped until the API catches up
+const progressBuffer = 64
+
+// progress reports stages of a task to the API in the background as soon as
+// they complete. Reporting is best-effort: the final results are submitted
+// anyway once the task is finished.
+type progress struct {
+	task   *models.Task
+	api    *client.Client
+	stages chan *models.Stage
+	done   chan struct{}
+}
+
+func (rr *Runner) newProgress(task *models.Task) *progress {
+	p := &progress{
+		task:   task,
+		api:    rr.apiClient(),
+		stages: make(chan *models.Stage, progressBuffer),
+		done:   make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *progress) report(stages ...*models.Stage) {
+	for _, s := range stages {
+		select {
+		case p.stages <- s:
+		default:
+			log.Printf("[WARN] [%s] progress of `%s` dropped", p.task.Ref, s.Name)
+		}
+	}
+}
+
+// close waits for the pending stages to be reported
+func (p *progress) close() {
+	close(p.stages)
+	<-p.done
+}
+
+func (p *progress) loop() {
+	defer close(p.done)
+	for s := range p.stages {
+		batch := []*models.Stage{s}
+	drain:
+		for {
+			select {
+			case s, ok := <-p.stages:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, s)
+			default:
+				break drain
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+		if err := p.api.ReportStages(ctx, p.task.Id, batch); err != nil {
+			log.Printf("[WARN] [%s] could not report progress: %v", p.task.Ref, err)
+		}
+		cancel()
+	}
+}
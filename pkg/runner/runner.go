@@ -6,29 +6,46 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/mkuznets/classbox/pkg/api/client"
+	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/mkuznets/classbox/pkg/docker"
 	"github.com/mkuznets/classbox/pkg/fileutils"
 	"github.com/mkuznets/classbox/pkg/opts"
+	"github.com/mkuznets/classbox/pkg/storage"
 	"github.com/mkuznets/classbox/pkg/utils"
 	"github.com/pkg/errors"
 )
 
+const (
+	dequeueWait   = 15 * time.Second
+	pollInterval  = 3 * time.Second
+	reportTimeout = 30 * time.Second
+)
+
 type Runner struct {
-	Ctx     context.Context
-	Http    *http.Client
-	Env     *opts.Env
-	Jwt     *opts.JwtClient
-	Sentry  *opts.Sentry
-	Docker  *opts.Docker
-	DataDir string
-	ApiURL  string
-	WebURL  string
-	DocsURL string
+	Ctx         context.Context
+	Http        *http.Client
+	Env         *opts.Env
+	Jwt         *opts.JwtClient
+	Sentry      *opts.Sentry
+	Docker      *opts.Docker
+	Blobs       storage.BlobStore
+	MaxOutput   int
+	Course      string
+	DataDir     string
+	Concurrency int
+	ApiURL      string
+	WebURL      string
+	DocsURL     string
+	GracePeriod time.Duration
+	Regrade     bool
+	id          string
 }
 
 func (rr *Runner) apiClient() *client.Client {
@@ -38,17 +55,19 @@ func (rr *Runner) apiClient() *client.Client {
 	}
 	c := client.New(rr.ApiURL)
 	c.Auth(token)
+	c.SetCourse(rr.Course)
+	c.SetRunner(rr.id)
 	return c
 }
 
-func (rr *Runner) dockerClient() *docker.Client {
-	return &docker.Client{
-		BuilderImage: rr.Docker.BuilderImage,
-		RunnerImage:  rr.Docker.RunnerImage,
+func (rr *Runner) dockerClient() docker.Sandbox {
+	if rr.Docker.Backend == "cli" {
+		return docker.NewCLI(rr.Docker.BuilderImage, rr.Docker.RunnerImage)
 	}
+	return docker.NewEngine(rr.Docker.Host, rr.Docker.BuilderImage, rr.Docker.RunnerImage)
 }
 
-func (rr *Runner) newStore(ref string, createBaselines bool) (*Store, error) {
+func (rr *Runner) newStore(ctx context.Context, ref string, createBaselines bool) (*Store, error) {
 
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -60,6 +79,7 @@ func (rr *Runner) newStore(ref string, createBaselines bool) (*Store, error) {
 		dataDir:         rr.DataDir,
 		tmpDir:          tmpDir,
 		createBaselines: createBaselines,
+		concurrency:     rr.Concurrency,
 		dockerClient:    rr.dockerClient(),
 	}
 
@@ -99,7 +119,21 @@ func (rr *Runner) newStore(ref string, createBaselines bool) (*Store, error) {
 
 	api := rr.apiClient()
 
-	cachedRuns, err := api.GetRuns(rr.Ctx, utils.UniqueStringFields(st.artifacts, "Hash"))
+	tests, err := api.GetTests(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	meta := make(map[string]*models.Test, len(tests))
+	for _, t := range tests {
+		meta[t.Name] = t
+	}
+	for _, a := range st.artifacts {
+		if t, ok := meta[a.Test]; ok {
+			a.Meta = *t
+		}
+	}
+
+	cachedRuns, err := api.GetRuns(ctx, utils.UniqueStringFields(st.artifacts, "Hash"))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -110,7 +144,7 @@ func (rr *Runner) newStore(ref string, createBaselines bool) (*Store, error) {
 	}
 
 	if !createBaselines {
-		baselines, err := api.GetBaselines(rr.Ctx, utils.UniqueStringFields(st.artifacts, "Test"))
+		baselines, err := api.GetBaselines(ctx, utils.UniqueStringFields(st.artifacts, "Test"))
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -124,10 +158,24 @@ func (rr *Runner) newStore(ref string, createBaselines bool) (*Store, error) {
 
 func (rr *Runner) Do() {
 	log.Printf("[INFO] environment: %s", rr.Env.Type)
+	log.Printf("[INFO] course: %s", rr.Course)
+
+	rr.id = uuid.New().String()
+	interval, err := rr.register(rr.Ctx)
+	if err != nil {
+		return
+	}
+	log.Printf("[INFO] registered runner id=%s", rr.id)
+
+	// Heartbeats must outlive the shutdown signal to keep the lease of
+	// the task that is still completing.
+	hbCtx, stopHeartbeat := context.WithCancel(context.Background())
+	defer stopHeartbeat()
+	go rr.heartbeat(hbCtx, interval)
 
 	upgradeRetries := 0
 
-	for {
+	for rr.Ctx.Err() == nil {
 		api := rr.apiClient()
 
 		err := func() error {
@@ -151,30 +199,100 @@ func (rr *Runner) Do() {
 			return nil
 		}()
 
-		if err != nil {
+		if err != nil && rr.Ctx.Err() == nil {
 			log.Printf("[WARN] could not upgrade course: %v", err)
 			upgradeRetries++
 		}
 
-		func() {
-			task, err := api.DequeueTask(rr.Ctx)
+		started := time.Now()
+		executed := func() bool {
+			task, err := api.DequeueTask(rr.Ctx, dequeueWait)
 			if err != nil {
-				log.Printf("[ERR] could not dequeue task: %v", err)
-				return
+				if rr.Ctx.Err() == nil {
+					log.Printf("[ERR] could not dequeue task: %v", err)
+				}
+				return false
 			}
 			if task == nil {
-				return
+				return false
 			}
 
 			log.Printf("[INFO] [%s] new task id=%s", task.Ref, task.Id)
-			defer rr.finishTask(task)
+			rr.execute(task)
+			return true
+		}()
 
-			err = rr.runTask(task)
-			if err != nil {
-				log.Printf("[ERR] [%s] execution error: %v", task.Ref, err)
+		// Fall back to polling if the API does not support long polling or fails.
+		if !executed && time.Since(started) < pollInterval {
+			select {
+			case <-rr.Ctx.Done():
+			case <-time.After(pollInterval):
 			}
-		}()
+		}
+	}
 
-		time.Sleep(3 * time.Second)
+	log.Printf("[INFO] runner stopped")
+}
+
+// execute runs the task and reports the results. On shutdown the task is given
+// the grace period to complete, after that it is aborted and handed back.
+func (rr *Runner) execute(task *models.Task) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rr.Ctx.Done():
+		}
+		log.Printf("[INFO] [%s] shutting down, waiting %v for the task to complete", task.Ref, rr.GracePeriod)
+		select {
+		case <-ctx.Done():
+		case <-time.After(rr.GracePeriod):
+			cancel()
+		}
+	}()
+
+	err := rr.runTask(ctx, task)
+	if ctx.Err() != nil {
+		rr.releaseTask(task)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERR] [%s] execution error: %v", task.Ref, err)
+	}
+	rr.finishTask(task)
+}
+
+// register registers the runner, retrying until it succeeds, and returns
+// the interval between heartbeats requested by the API.
+func (rr *Runner) register(ctx context.Context) (time.Duration, error) {
+	hostname, _ := os.Hostname()
+	for {
+		runner, err := rr.apiClient().RegisterRunner(ctx, hostname)
+		if err == nil {
+			return time.Duration(runner.Interval) * time.Second, nil
+		}
+		log.Printf("[WARN] could not register runner: %v", err)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// heartbeat keeps the runner registered and extends leases of its tasks
+func (rr *Runner) heartbeat(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if v, err := rr.register(ctx); err == nil {
+			interval = v
+		}
 	}
 }
@@ -2,9 +2,11 @@ package runner
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/mkuznets/classbox/pkg/docker"
@@ -14,6 +16,7 @@ import (
 
 type Artifact struct {
 	Test     string
+	Meta     models.Test
 	Path     string
 	Hash     string
 	Cache    *models.Run
@@ -26,8 +29,12 @@ type Store struct {
 	dataDir         string
 	tmpDir          string
 	createBaselines bool
+	concurrency     int
 	artifacts       []*Artifact
-	dockerClient    *docker.Client
+	dockerClient    docker.Sandbox
+	// onComplete, if set, is called as soon as the run of an artifact is
+	// final. It may be called concurrently.
+	onComplete func(a *Artifact)
 }
 
 func (s *Store) Execute(ctx context.Context) error {
@@ -38,64 +45,162 @@ func (s *Store) Execute(ctx context.Context) error {
 	//noinspection GoUnhandledErrorResult
 	defer os.RemoveAll(s.tmpDir)
 
+	pending := make([]*Artifact, 0, len(s.artifacts))
 	for _, a := range s.artifacts {
-
 		if a.Cache != nil {
 			log.Printf("[INFO] [%s] Using cache for `%v` (hash=%v)", s.ref, a.Test, a.Hash[:16])
 			c := *a.Cache
 			a.Run = &c
-			if !s.createBaselines {
-				a.Run.CompareToBaseline(a.Baseline)
-			}
+			s.complete(a)
 			continue
 		}
+		pending = append(pending, a)
+	}
 
-		err := fileutils.CleanDir(s.dataDir)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		testPath := filepath.Join(s.dataDir, filepath.Base(a.Path))
-		err = fileutils.Copy(a.Path, testPath)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		_ = os.Chmod(testPath, 0500)
-		_ = os.Chown(testPath, 2000, 2000)
+	if err := s.runUnitTests(ctx, pending); err != nil {
+		return err
+	}
 
-		run := &models.Run{Hash: a.Hash}
-		err = s.dockerClient.RunTest(ctx, a.Test, run)
-		if err != nil {
-			log.Printf("[ERR] [%s] error during unit tests `%s`: %v", s.ref, a.Test, err)
+	// Perf measurements are not parallelised to keep them stable.
+	for _, a := range pending {
+		if a.Run == nil || a.Run.Status != "success" {
 			continue
 		}
-
-		log.Printf("[INFO] [%s] `%s` unit tests: %s", s.ref, a.Test, run.Status)
-
-		if run.Status == "success" {
-			var perfRun models.Run
-			err := s.dockerClient.RunPerf(ctx, a.Test, &perfRun)
-			if err != nil {
-				log.Printf("[ERR] [%s] error during perf measuring `%s`: %v", s.ref, a.Test, err)
-				continue
-			}
-			if perfRun.Status != "success" {
-				log.Printf("[INFO] [%s] `%s` perf tests failed: %v", s.ref, a.Test, perfRun.Output)
-				run.Status, run.Output = perfRun.Status, perfRun.Output
-			} else {
-				log.Printf("[INFO] [%s] `%s` perf tests: %v", s.ref, a.Test, perfRun.Score)
-				run.Score = perfRun.Score
-			}
+		if err := s.runPerf(ctx, a); err != nil {
+			return err
 		}
-		a.Run = run
+		s.complete(a)
 	}
 
+	return nil
+}
+
+// complete compares the run of the artifact to its baseline, computes the
+// credit and reports the run as final.
+func (s *Store) complete(a *Artifact) {
+	if a.Run == nil {
+		return
+	}
 	if !s.createBaselines {
-		for _, a := range s.artifacts {
-			if a.Run != nil {
-				a.Run.CompareToBaseline(a.Baseline)
+		a.Run.CompareToBaseline(a.Baseline, a.Meta.PerfPolicy())
+	}
+	a.Run.Credit = a.Meta.Credit(a.Run)
+	if s.onComplete != nil {
+		s.onComplete(a)
+	}
+}
+
+// runUnitTests runs unit tests of the given artifacts using a pool of workers.
+// Each worker has its own subdirectory in the data volume.
+func (s *Store) runUnitTests(ctx context.Context, artifacts []*Artifact) error {
+	if len(artifacts) == 0 {
+		return nil
+	}
+	workers := s.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(artifacts) {
+		workers = len(artifacts)
+	}
+
+	queue := make(chan *Artifact, len(artifacts))
+	for _, a := range artifacts {
+		queue <- a
+	}
+	close(queue)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(slot string) {
+			defer wg.Done()
+			for a := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := s.runUnit(ctx, slot, a); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
 			}
-		}
+		}(fmt.Sprintf("worker-%d", i))
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+func (s *Store) runUnit(ctx context.Context, slot string, a *Artifact) error {
+	if err := s.prepare(slot, a); err != nil {
+		return err
+	}
+
+	run := &models.Run{Hash: a.Hash}
+	err := s.dockerClient.RunTest(ctx, slot, a.Test, &a.Meta.Limits, run)
+	if err != nil {
+		log.Printf("[ERR] [%s] error during unit tests `%s`: %v", s.ref, a.Test, err)
+		return nil
 	}
 
+	log.Printf("[INFO] [%s] `%s` unit tests: %s", s.ref, a.Test, run.Status)
+	a.Run = run
+	if run.Status != "success" {
+		// no perf measurements, the run is final
+		s.complete(a)
+	}
+	return nil
+}
+
+func (s *Store) runPerf(ctx context.Context, a *Artifact) error {
+	const slot = "perf"
+	if err := s.prepare(slot, a); err != nil {
+		return err
+	}
+
+	run := a.Run
+	var perfRun models.Run
+	policy := a.Meta.PerfPolicy()
+	err := s.dockerClient.RunPerf(ctx, slot, a.Test, &a.Meta.Limits, &policy, &perfRun)
+	if err != nil {
+		log.Printf("[ERR] [%s] error during perf measuring `%s`: %v", s.ref, a.Test, err)
+		a.Run = nil
+		return nil
+	}
+	if perfRun.Status != "success" {
+		log.Printf("[INFO] [%s] `%s` perf tests failed: %v", s.ref, a.Test, perfRun.Output)
+		run.Status, run.Output = perfRun.Status, perfRun.Output
+	} else {
+		log.Printf("[INFO] [%s] `%s` perf tests: %v", s.ref, a.Test, perfRun.Score)
+		run.Score, run.Metrics = perfRun.Score, perfRun.Metrics
+	}
+	return nil
+}
+
+// prepare copies the test binary into a clean subdirectory of the data volume
+func (s *Store) prepare(slot string, a *Artifact) error {
+	dir := filepath.Join(s.dataDir, slot)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fileutils.CleanDir(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	testPath := filepath.Join(dir, filepath.Base(a.Path))
+	if err := fileutils.Copy(a.Path, testPath); err != nil {
+		return errors.WithStack(err)
+	}
+	_ = os.Chmod(testPath, 0500)
+	_ = os.Chown(testPath, 2000, 2000)
 	return nil
 }
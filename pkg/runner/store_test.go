@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/mkuznets/classbox/pkg/docker"
+	"github.com/mkuznets/classbox/pkg/fileutils"
+)
+
+func TestStoreExecute(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	tmpDir, err := ioutil.TempDir("", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sandbox := &docker.Fake{
+		DataDir: dataDir,
+		Tests:   []*models.Test{{Name: "heap"}, {Name: "trie"}, {Name: "sort"}},
+		Runs:    map[string]*models.Run{"trie": {Status: "failure", Output: "FAIL"}},
+		Score:   42,
+	}
+	if r := sandbox.BuildTests(context.Background(), "url"); !r.Success() {
+		t.Fatalf("build failed: %s", r.Output)
+	}
+
+	st := &Store{
+		ref:             "test",
+		dataDir:         dataDir,
+		tmpDir:          tmpDir,
+		createBaselines: true,
+		concurrency:     2,
+		dockerClient:    sandbox,
+	}
+	for _, test := range sandbox.Tests {
+		path := filepath.Join(tmpDir, test.Name+".test")
+		if err := fileutils.Copy(filepath.Join(dataDir, test.Name+".test"), path); err != nil {
+			t.Fatal(err)
+		}
+		st.artifacts = append(st.artifacts, &Artifact{
+			Test: test.Name,
+			Path: path,
+			Hash: test.Name + "-0123456789abcdef",
+		})
+	}
+	st.artifacts[2].Cache = &models.Run{Status: "success", Score: 7, Test: "sort"}
+
+	if err := st.Execute(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct {
+		status string
+		score  uint64
+	}{
+		"heap": {"success", 42},
+		"trie": {"failure", 0},
+		"sort": {"success", 7},
+	}
+	for _, a := range st.artifacts {
+		e := expected[a.Test]
+		if a.Run == nil {
+			t.Fatalf("`%s`: no run", a.Test)
+		}
+		if a.Run.Status != e.status || a.Run.Score != e.score {
+			t.Fatalf("`%s`: expected %s/%d, got %s/%d", a.Test, e.status, e.score, a.Run.Status, a.Run.Score)
+		}
+	}
+
+	for _, call := range sandbox.Calls {
+		if call == "run test sort" || call == "run perf trie" {
+			t.Fatalf("unexpected call: %s", call)
+		}
+	}
+}
@@ -1,27 +1,49 @@
 package runner
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/http"
 
+	"github.com/mkuznets/classbox/pkg/api/client"
 	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/mkuznets/classbox/pkg/fileutils"
 	"github.com/pkg/errors"
 )
 
 func (rr *Runner) finishTask(task *models.Task) {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
 	api := rr.apiClient()
-	if err := api.SubmitRuns(rr.Ctx, task.Runs); err != nil {
+	if err := api.SubmitRuns(ctx, task.Runs); err != nil {
 		log.Printf("[WARN] [%s] could not submit runs: %v", task.Ref, err)
 	}
-	if err := api.FinishTask(rr.Ctx, task.Id, task.Stages); err != nil {
+	if err := api.FinishTask(ctx, task.Id, task.Stages); err != nil {
+		if e, ok := err.(client.ErrorResponse); ok && e.Code == http.StatusConflict {
+			log.Printf("[WARN] [%s] task lease has been lost, results discarded", task.Ref)
+			return
+		}
 		log.Printf("[ERR] [%s] could not finish task: %v", task.Ref, err)
 		return
 	}
 	log.Printf("[INFO] [%s] finished", task.Ref)
 }
 
-func (rr *Runner) runTask(task *models.Task) error {
+// releaseTask hands an aborted task back to the queue
+func (rr *Runner) releaseTask(task *models.Task) {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
+	if err := rr.apiClient().ReleaseTask(ctx, task.Id); err != nil {
+		log.Printf("[ERR] [%s] could not release task: %v", task.Ref, err)
+		return
+	}
+	log.Printf("[INFO] [%s] aborted and re-enqueued", task.Ref)
+}
+
+func (rr *Runner) runTask(ctx context.Context, task *models.Task) error {
 	dcl := rr.dockerClient()
 
 	err := fileutils.CleanDir(rr.DataDir)
@@ -29,12 +51,18 @@ func (rr *Runner) runTask(task *models.Task) error {
 		return err
 	}
 
-	r := dcl.BuildTests(rr.Ctx, task.Url)
+	progress := rr.newProgress(task)
+	defer progress.close()
+
+	r := dcl.BuildTests(ctx, task.Url)
+	for _, s := range r.Stages {
+		s.LogKey = rr.keepLog(ctx, fmt.Sprintf("tasks/%s/%s", task.Id, s.Name), &s.Output)
+	}
 	task.Stages = append(task.Stages, r.Stages...)
 
 	log.Printf("[INFO] [%s] build completed", task.Ref)
 
-	store, err := rr.newStore(task.Ref, false)
+	store, err := rr.newStore(ctx, task.Ref, false)
 	if err != nil {
 		task.ReportSystemError("")
 		return errors.WithStack(err)
@@ -58,9 +86,17 @@ func (rr *Runner) runTask(task *models.Task) error {
 			st.Cached = true
 		}
 	}
+	progress.report(task.Stages...)
+
+	store.onComplete = func(a *Artifact) {
+		rr.keepRunLog(ctx, a)
+		stage := &models.Stage{Cached: a.Cache != nil}
+		stage.FillFromRun("test", a.Run)
+		progress.report(stage)
+	}
 
 	log.Printf("[INFO] [%s] tests found: %d", task.Ref, len(store.artifacts))
-	err = store.Execute(rr.Ctx)
+	err = store.Execute(ctx)
 	if err != nil {
 		task.ReportSystemError("")
 		return errors.WithStack(err)
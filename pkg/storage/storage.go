@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/mkuznets/classbox/pkg/opts"
+	"github.com/mkuznets/classbox/pkg/s3"
+	"github.com/pkg/errors"
+)
+
+// URLExpiry is how long download URLs of local blobs are valid
+const URLExpiry = 10 * time.Minute
+
+// BlobStore keeps repository archives and logs, and gives out temporary
+// URLs to download them.
+type BlobStore interface {
+	Upload(ctx context.Context, key string, body io.Reader) error
+	URL(ctx context.Context, key string) (string, error)
+}
+
+var (
+	_ BlobStore = (*s3.S3)(nil)
+	_ BlobStore = (*Local)(nil)
+)
+
+// New returns the blob store selected by the options
+func New(st *opts.Storage, aws *opts.AWS) (BlobStore, error) {
+	switch st.Backend {
+	case "local":
+		if st.Dir == "" {
+			return nil, errors.New("directory is required for the local storage")
+		}
+		return NewLocal(st.Dir, st.URL, st.Secret), nil
+	default:
+		if aws.Region == "" || aws.Bucket == "" {
+			return nil, errors.New("AWS region and bucket are required for the s3 storage")
+		}
+		return s3.New(aws.Session(), aws.Bucket), nil
+	}
+}
@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"fmt"
 	"math/rand"
 	"reflect"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -44,3 +46,16 @@ func RandomString(length int) string {
 	}
 	return b.String()
 }
+
+// Truncate cuts the string to at most n bytes, not splitting multibyte
+// characters, and notes how much has been cut.
+func Truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	cut := n
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n... (%d bytes truncated)", s[:cut], len(s)-cut)
+}
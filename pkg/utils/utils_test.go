@@ -30,3 +30,21 @@ func TestMapStringKeys(t *testing.T) {
 		t.Fatalf("expected %v, got %v", expected, keys)
 	}
 }
+
+func TestTruncate(t *testing.T) {
+	cases := []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"too long", 3, "too\n... (5 bytes truncated)"},
+		{"привет", 3, "п\n... (10 bytes truncated)"},
+	}
+	for _, c := range cases {
+		if v := utils.Truncate(c.s, c.n); v != c.expected {
+			t.Fatalf("expected %q, got %q", c.expected, v)
+		}
+	}
+}
@@ -1,12 +1,26 @@
 package web
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
 )
 
 func (web *Web) GetSignin(w http.ResponseWriter, r *http.Request) {
 
+	// Github redirects back to a fixed callback URL, the actual course is
+	// encoded in the state.
+	state := r.URL.Query().Get("state")
+	if parts := strings.SplitN(state, ".", 2); len(parts) == 2 && parts[0] != chi.URLParam(r, "project") {
+		u := *r.URL
+		u.Path = fmt.Sprintf("/%s/signin", parts[0])
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+
 	switch r.URL.Query().Get("step") {
 
 	default:
@@ -102,5 +116,5 @@ func (web *Web) Logout(w http.ResponseWriter, r *http.Request) {
 		MaxAge: -1,
 		Path:   "/stdlib",
 	})
-	http.Redirect(w, r, web.WebURL, http.StatusFound)
+	http.Redirect(w, r, fmt.Sprintf("%s/%s", web.WebURL, chi.URLParam(r, "project")), http.StatusFound)
 }
@@ -1,11 +1,27 @@
 package web
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/mkuznets/classbox/pkg/api/models"
+	"github.com/pkg/errors"
 )
 
+// streamWait is how long the API is asked to wait for progress of a commit
+const streamWait = 20 * time.Second
+
+type commitPage struct {
+	Commit   *models.Commit
+	Queue    *models.Queue
+	CanRerun bool
+}
+
 func (web *Web) GetCommit(w http.ResponseWriter, r *http.Request) {
 
 	commitHash := chi.URLParam(r, "commitHash")
@@ -17,14 +33,100 @@ func (web *Web) GetCommit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page := &commitPage{Commit: commit}
+	if user, ok := r.Context().Value("User").(*models.User); ok {
+		page.CanRerun = user.Login == commit.Login && commit.Status == "FINISHED"
+	}
+
 	tpl, err := web.Templates.New("commit")
 	if err != nil {
 		web.HandleError(w, r, err)
 		return
 	}
 
-	if err := web.Render(w, tpl, commit); err != nil {
+	if commit.Status == "ENQUEUED" || commit.Status == "EXECUTING" {
+		page.Queue, err = web.API(r).GetQueue(r.Context(), login, commitHash)
+		if err != nil {
+			web.HandleError(w, r, err)
+			return
+		}
+		if commit.Status == "ENQUEUED" {
+			err = web.Templates.EnableRefresh(tpl, queueRefresh)
+		} else {
+			err = web.Templates.EnableStream(tpl)
+		}
+		if err != nil {
+			web.HandleError(w, r, err)
+			return
+		}
+	}
+
+	if err := web.Render(w, tpl, page); err != nil {
 		web.HandleError(w, r, err)
 		return
 	}
 }
+
+func (web *Web) RerunCommit(w http.ResponseWriter, r *http.Request) {
+
+	commitHash := chi.URLParam(r, "commitHash")
+	login := chi.URLParam(r, "login")
+
+	if err := web.API(r).RerunCommit(r.Context(), login, commitHash); err != nil {
+		web.HandleError(w, r, err)
+		return
+	}
+
+	url := fmt.Sprintf("/%s/commit/%s:%s", chi.URLParam(r, "project"), login, commitHash)
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// StreamCommit sends Server-Sent Events about the check of the commit: "stage"
+// for each stage reported after the first ?after=... ones and "finished" once
+// the check is over.
+func (web *Web) StreamCommit(w http.ResponseWriter, r *http.Request) {
+
+	commitHash := chi.URLParam(r, "commitHash")
+	login := chi.URLParam(r, "login")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		web.HandleError(w, r, errors.New("streaming is not supported"))
+		return
+	}
+	after, err := strconv.Atoi(r.URL.Query().Get("after"))
+	if err != nil || after < 0 {
+		after = 0
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	api := web.API(r)
+	for {
+		progress, err := api.GetProgress(r.Context(), login, commitHash, after, streamWait)
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("[WARN] could not get progress of %s:%s: %v", login, commitHash, err)
+			}
+			return
+		}
+		for _, s := range progress.Stages {
+			data, err := json.Marshal(s)
+			if err != nil {
+				log.Printf("[ERR] %v", err)
+				return
+			}
+			fmt.Fprintf(w, "event: stage\ndata: %s\n\n", data)
+		}
+		after = progress.Total
+		if progress.Status != "ENQUEUED" && progress.Status != "EXECUTING" {
+			fmt.Fprintf(w, "event: finished\ndata: %s\n\n", progress.Status)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
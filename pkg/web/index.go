@@ -4,18 +4,21 @@ import (
 	"math"
 	"net/http"
 
+	"github.com/go-chi/chi"
+
 	"github.com/mkuznets/classbox/pkg/api/models"
 )
 
 type indexPage struct {
+	Course  string
 	User    *models.User
 	DocsURL string
 	Stats   *models.UserStats
 	Grade   float64
 }
 
-func gradeFromScore(score uint64) float64 {
-	preGrade := float64(score) / 10.
+func gradeFromScore(score float64) float64 {
+	preGrade := score / 10.
 	grade := math.Min(10., preGrade)
 	return grade
 }
@@ -28,6 +31,7 @@ func (web *Web) GetIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	page := &indexPage{
+		Course:  chi.URLParam(r, "project"),
 		User:    user,
 		DocsURL: web.DocsURL,
 	}
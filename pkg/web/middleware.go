@@ -3,6 +3,7 @@ package web
 import (
 	"context"
 	"net/http"
+	"net/url"
 
 	"github.com/go-chi/chi"
 	"github.com/mkuznets/classbox/pkg/api/client"
@@ -23,10 +24,42 @@ func sessionAuth(API func(r *http.Request) *client.Client) func(next http.Handle
 	}
 }
 
-func validateProject(next http.Handler) http.Handler {
+func validateProject(API func(r *http.Request) *client.Client, fallback string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			courses, err := API(r).GetCourses(r.Context())
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			project := chi.URLParam(r, "project")
+			for _, c := range courses {
+				if c.Name == project {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Redirect(w, r, "/"+fallback, http.StatusFound)
+		})
+	}
+}
+
+// sameOrigin protects cookie-authenticated forms from cross-site requests:
+// the Origin header, or Referer if there is none, has to match the website.
+func (web *Web) sameOrigin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if chi.URLParam(r, "project") != "stdlib" {
-			http.Redirect(w, r, "/stdlib", http.StatusMovedPermanently)
+		source := r.Header.Get("Origin")
+		if source == "" {
+			source = r.Header.Get("Referer")
+		}
+		site, err := url.Parse(web.WebURL)
+		if err != nil {
+			web.HandleError(w, r, err)
+			return
+		}
+		u, err := url.Parse(source)
+		if source == "" || err != nil || u.Scheme != site.Scheme || u.Host != site.Host {
+			web.SendError(w, r, http.StatusForbidden, "Cross-site requests are not allowed.")
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -0,0 +1,43 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/mkuznets/classbox/pkg/api/models"
+)
+
+// queueRefresh is how often pages showing the queue are reloaded, in seconds
+const queueRefresh = 10
+
+type queuePage struct {
+	Course string
+	User   *models.User
+	Queue  *models.Queue
+}
+
+func (web *Web) GetQueue(w http.ResponseWriter, r *http.Request) {
+	queue, err := web.API(r).GetQueue(r.Context(), "", "")
+	if err != nil {
+		web.HandleError(w, r, err)
+		return
+	}
+	var user *models.User
+	if v, ok := r.Context().Value("User").(*models.User); ok {
+		user = v
+	}
+
+	tpl, err := web.Templates.New("queue")
+	if err != nil {
+		web.HandleError(w, r, err)
+		return
+	}
+	if err := web.Templates.EnableRefresh(tpl, queueRefresh); err != nil {
+		web.HandleError(w, r, err)
+		return
+	}
+	if err := web.Render(w, tpl, &queuePage{chi.URLParam(r, "project"), user, queue}); err != nil {
+		web.HandleError(w, r, err)
+		return
+	}
+}
@@ -3,12 +3,16 @@ package web
 import (
 	"net/http"
 
+	"github.com/go-chi/chi"
+
 	"github.com/mkuznets/classbox/pkg/api/models"
 )
 
 type scoreboardPage struct {
-	User  *models.User
-	Stats []*models.Stat
+	Course string
+	User   *models.User
+	Stats  []*models.Stat
+	Stale  bool // some results were graded by an older version
 }
 
 func (web *Web) GetScoreboard(w http.ResponseWriter, r *http.Request) {
@@ -21,12 +25,16 @@ func (web *Web) GetScoreboard(w http.ResponseWriter, r *http.Request) {
 	if v, ok := r.Context().Value("User").(*models.User); ok {
 		user = v
 	}
+	page := &scoreboardPage{Course: chi.URLParam(r, "project"), User: user, Stats: stats}
+	for _, s := range stats {
+		page.Stale = page.Stale || s.Stale > 0
+	}
 	tpl, err := web.Templates.New("scoreboard")
 	if err != nil {
 		web.HandleError(w, r, err)
 		return
 	}
-	if err := web.Render(w, tpl, &scoreboardPage{user, stats}); err != nil {
+	if err := web.Render(w, tpl, page); err != nil {
 		web.HandleError(w, r, err)
 		return
 	}
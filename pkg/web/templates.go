@@ -9,6 +9,7 @@ import (
 	"path"
 	"strings"
 
+	"github.com/mkuznets/classbox/pkg/api/models"
 	"github.com/pkg/errors"
 	"github.com/rakyll/statik/fs"
 )
@@ -47,12 +48,18 @@ func NewTemplates() (*Templates, error) {
 				return "\u2705"
 			case "FAILURE":
 				return "\u274c"
+			case "TIME_LIMIT_EXCEEDED":
+				return "\u23f0"
+			case "MEMORY_LIMIT_EXCEEDED":
+				return "\U0001f4be"
 			case "ENQUEUED":
 				return "\u23f3"
 			case "EXECUTING":
 				return "\U0001f3c3\u200d\u2640\ufe0f"
 			case "FINISHED":
 				return "\U0001f3c1"
+			case "SKIPPED":
+				return "\u23ed\ufe0f"
 			default:
 				return v
 			}
@@ -63,10 +70,33 @@ func NewTemplates() (*Templates, error) {
 				return ":heavy_check_mark:"
 			case "failure":
 				return ":x:"
+			case "time_limit_exceeded":
+				return ":alarm_clock:"
+			case "memory_limit_exceeded":
+				return ":floppy_disk:"
 			default:
 				return v
 			}
 		},
+		"testStatus": func(v string) string {
+			switch v {
+			case "pass":
+				return "\u2705"
+			case "fail":
+				return "\u274c"
+			case "skip":
+				return "\u23ed\ufe0f"
+			default:
+				return v
+			}
+		},
+		"resultsSummary": func(results []*models.TestResult) string {
+			count := map[string]int{}
+			for _, r := range results {
+				count[r.Status]++
+			}
+			return fmt.Sprintf("%d passed, %d failed, %d skipped", count["pass"], count["fail"], count["skip"])
+		},
 		"unescape": func(str string) template.HTML {
 			return template.HTML(str)
 		},
@@ -87,6 +117,24 @@ func NewTemplates() (*Templates, error) {
 		return nil, errors.WithStack(err)
 	}
 
+	_, err = tpl.base.New("refresh").Parse("")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = tpl.base.New("stream").Parse("")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	partial, err := tpl.readFile("/templates/queue_status.md")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := tpl.base.New("queue_status").Parse(partial); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	return tpl, nil
 }
 
@@ -131,3 +179,25 @@ func (t *Templates) EnableMath(tpl *template.Template) error {
 	}
 	return nil
 }
+
+// EnableRefresh makes the page reload itself every given number of seconds
+func (t *Templates) EnableRefresh(tpl *template.Template, seconds int) error {
+	html := fmt.Sprintf(`<meta http-equiv="refresh" content="%d">`, seconds)
+	if _, err := tpl.New("refresh").Parse(html); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// EnableStream makes the commit page reload itself whenever the check of the
+// commit progresses
+func (t *Templates) EnableStream(tpl *template.Template) error {
+	html, err := t.readFile("/templates/stream.html")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := tpl.New("stream").Parse(html); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -34,7 +34,6 @@ func (s *Server) Start() {
 
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.Logger)
-	router.Use(middleware.Timeout(10 * time.Second))
 
 	if s.Sentry.Init(s.Env.Type, "web") {
 		sentryMiddleware := sentryhttp.New(sentryhttp.Options{
@@ -48,19 +47,26 @@ func (s *Server) Start() {
 		r.Mount("/.static", staticServer)
 		r.Mount(`/{:*\.(png|svg|ico|webmanifest)}`, staticServer)
 		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-			http.Redirect(w, r, "/stdlib", http.StatusMovedPermanently)
+			http.Redirect(w, r, "/"+s.Web.Course, http.StatusFound)
 		})
-		router.With(validateProject).Route("/{project:[0-9a-z]+}", func(r chi.Router) {
-			r.With(sessionAuth(s.Web.API)).Group(func(r chi.Router) {
-				r.Get("/", s.Web.GetIndex)
-				r.Get("/scoreboard", s.Web.GetScoreboard)
-				r.Get("/commit/{login}:{commitHash:[0-9a-z]+}", s.Web.GetCommit)
-				r.Get("/quickstart", s.Web.GetQuickstart)
-				r.Get("/prerequisites", s.Web.GetPrerequisites)
-				r.Get("/grading", s.Web.GetGrading)
+		router.With(validateProject(s.Web.API, s.Web.Course)).Route("/{project:[0-9a-z-]+}", func(r chi.Router) {
+			// event streams are long-lived and are not subject to the timeout
+			r.Get("/commit/{login}:{commitHash:[0-9a-z]+}/events", s.Web.StreamCommit)
+
+			r.With(middleware.Timeout(10 * time.Second)).Group(func(r chi.Router) {
+				r.With(sessionAuth(s.Web.API)).Group(func(r chi.Router) {
+					r.Get("/", s.Web.GetIndex)
+					r.Get("/scoreboard", s.Web.GetScoreboard)
+					r.Get("/queue", s.Web.GetQueue)
+					r.Get("/commit/{login}:{commitHash:[0-9a-z]+}", s.Web.GetCommit)
+					r.With(s.Web.sameOrigin).Post("/commit/{login}:{commitHash:[0-9a-z]+}/rerun", s.Web.RerunCommit)
+					r.Get("/quickstart", s.Web.GetQuickstart)
+					r.Get("/prerequisites", s.Web.GetPrerequisites)
+					r.Get("/grading", s.Web.GetGrading)
+				})
+				r.Get("/signin", s.Web.GetSignin)
+				r.Get("/logout", s.Web.Logout)
 			})
-			r.Get("/signin", s.Web.GetSignin)
-			r.Get("/logout", s.Web.Logout)
 		})
 	})
 
@@ -76,11 +82,13 @@ type Web struct {
 	DocsURL   string
 	ApiURL    string
 	WebURL    string
+	Course    string
 	Templates *Templates
 }
 
 func (web *Web) API(r *http.Request) *client.Client {
 	cl := client.New(web.ApiURL)
+	cl.SetCourse(chi.URLParam(r, "project"))
 	cookie, err := r.Cookie("session")
 	if err != nil {
 		return cl
@@ -0,0 +1,53 @@
+-- -----------------------------------------------------------------------------
+-- Multiple courses: tests, commits and user repositories are scoped by course.
+
+ALTER TABLE courses
+    ADD COLUMN template        text NOT NULL DEFAULT 'mkuznets/stdlib-template',
+    ADD COLUMN repository_name text NOT NULL DEFAULT 'hsecode-stdlib';
+
+-- -----------------------------------------------------------------------------
+
+DROP TABLE IF EXISTS enrollments CASCADE;
+CREATE TABLE IF NOT EXISTS enrollments
+(
+    id              bigserial PRIMARY KEY,
+    user_id         bigint REFERENCES users (id)   NOT NULL,
+    course_id       bigint REFERENCES courses (id) NOT NULL,
+    repository_id   bigint                         NOT NULL,
+    repository_name text                           NOT NULL
+);
+CREATE UNIQUE INDEX enrollments__user_course ON enrollments (user_id, course_id);
+CREATE UNIQUE INDEX enrollments__repository_id ON enrollments (repository_id);
+
+INSERT INTO enrollments (user_id, course_id, repository_id, repository_name)
+SELECT u.id, c.id, u.repository_id, u.repository_name
+FROM users AS u,
+     courses AS c
+WHERE c.name = 'stdlib';
+
+ALTER TABLE users
+    DROP COLUMN repository_id,
+    DROP COLUMN repository_name;
+
+-- -----------------------------------------------------------------------------
+
+ALTER TABLE tests
+    ADD COLUMN course_id bigint REFERENCES courses (id);
+UPDATE tests
+SET course_id=(SELECT id FROM courses WHERE name = 'stdlib');
+ALTER TABLE tests
+    ALTER COLUMN course_id SET NOT NULL,
+    DROP CONSTRAINT tests_name_key;
+CREATE UNIQUE INDEX tests__course_name ON tests (course_id, name);
+
+-- -----------------------------------------------------------------------------
+
+ALTER TABLE commits
+    ADD COLUMN course_id bigint REFERENCES courses (id);
+UPDATE commits
+SET course_id=(SELECT id FROM courses WHERE name = 'stdlib');
+ALTER TABLE commits
+    ALTER COLUMN course_id SET NOT NULL;
+DROP INDEX commits__user_commit;
+CREATE UNIQUE INDEX commits__user_course_commit ON commits (user_id, course_id, commit);
+CREATE INDEX commits__course_id ON commits (course_id);
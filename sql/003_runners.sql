@@ -0,0 +1,27 @@
+-- -----------------------------------------------------------------------------
+-- Runner registration and task leases.
+
+DROP TABLE IF EXISTS runners CASCADE;
+CREATE TABLE IF NOT EXISTS runners
+(
+    id            uuid PRIMARY KEY,
+    course_id     bigint REFERENCES courses (id) NOT NULL,
+    hostname      text                           NOT NULL,
+    registered_at timestamptz                    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    heartbeat_at  timestamptz                    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX runners__course_id ON runners (course_id);
+
+-- -----------------------------------------------------------------------------
+
+ALTER TABLE tasks
+    ADD COLUMN runner_id        uuid REFERENCES runners (id) DEFAULT NULL,
+    ADD COLUMN lease_expires_at timestamptz,
+    ADD COLUMN retries          int NOT NULL                 DEFAULT 0;
+CREATE INDEX "tasks__executing_idx" ON tasks (lease_expires_at) WHERE status = 'executing';
+
+-- Tasks that were executing before the upgrade have no owner, let the reaper
+-- handle them.
+UPDATE tasks
+SET lease_expires_at=CURRENT_TIMESTAMP
+WHERE status = 'executing';
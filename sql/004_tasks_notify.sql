@@ -0,0 +1,18 @@
+-- -----------------------------------------------------------------------------
+-- Notify long-polling runners about enqueued tasks. The payload is the course id.
+
+CREATE OR REPLACE FUNCTION notify_task_enqueued() RETURNS trigger AS
+$$
+BEGIN
+    PERFORM pg_notify('tasks', (SELECT course_id::text FROM commits WHERE id = NEW.commit_id));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tasks__notify_enqueued ON tasks;
+CREATE TRIGGER tasks__notify_enqueued
+    AFTER INSERT OR UPDATE OF status
+    ON tasks
+    FOR EACH ROW
+    WHEN (NEW.status = 'enqueued')
+EXECUTE PROCEDURE notify_task_enqueued();
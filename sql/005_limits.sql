@@ -0,0 +1,16 @@
+-- -----------------------------------------------------------------------------
+-- Per-test resource limits. Zero means the runner default.
+
+ALTER TABLE tests
+    ADD COLUMN timeout bigint           NOT NULL DEFAULT 0,
+    ADD COLUMN memory  bigint           NOT NULL DEFAULT 0,
+    ADD COLUMN cpus    double precision NOT NULL DEFAULT 0,
+    ADD COLUMN pids    bigint           NOT NULL DEFAULT 0;
+
+-- -----------------------------------------------------------------------------
+
+ALTER TYPE run_status_t ADD VALUE IF NOT EXISTS 'time_limit_exceeded';
+ALTER TYPE run_status_t ADD VALUE IF NOT EXISTS 'memory_limit_exceeded';
+
+ALTER TYPE check_status_t ADD VALUE IF NOT EXISTS 'time_limit_exceeded';
+ALTER TYPE check_status_t ADD VALUE IF NOT EXISTS 'memory_limit_exceeded';
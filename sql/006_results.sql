@@ -0,0 +1,8 @@
+-- -----------------------------------------------------------------------------
+-- Per-subtest results parsed from the verbose output of test binaries.
+
+ALTER TABLE runs
+    ADD COLUMN results jsonb DEFAULT NULL;
+
+ALTER TABLE checks
+    ADD COLUMN results jsonb DEFAULT NULL;
@@ -0,0 +1,19 @@
+-- -----------------------------------------------------------------------------
+-- Partial credit: tests declare weighted subtests and a score policy, runs and
+-- checks record the earned fraction of the test score.
+
+ALTER TABLE tests
+    ADD COLUMN policy   text NOT NULL DEFAULT 'all-or-nothing',
+    ADD COLUMN subtests jsonb         DEFAULT NULL;
+
+ALTER TABLE runs
+    ADD COLUMN credit double precision NOT NULL DEFAULT 0;
+UPDATE runs
+SET credit=1
+WHERE status = 'success';
+
+ALTER TABLE checks
+    ADD COLUMN credit double precision NOT NULL DEFAULT 0;
+UPDATE checks
+SET credit=1
+WHERE status = 'success';
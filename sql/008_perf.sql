@@ -0,0 +1,8 @@
+-- -----------------------------------------------------------------------------
+-- Per-test perf policies and perf metrics of runs.
+
+ALTER TABLE tests
+    ADD COLUMN perf jsonb DEFAULT NULL;
+
+ALTER TABLE runs
+    ADD COLUMN metrics jsonb DEFAULT NULL;
@@ -0,0 +1,56 @@
+-- -----------------------------------------------------------------------------
+-- Deadlines of a whole course, a topic or a single test, and per-user
+-- extensions of them.
+
+DROP TYPE IF EXISTS late_policy_t CASCADE;
+CREATE TYPE late_policy_t AS ENUM (
+    'reject',
+    'multiplier'
+    );
+
+DROP TABLE IF EXISTS deadlines CASCADE;
+CREATE TABLE IF NOT EXISTS deadlines
+(
+    id              bigserial PRIMARY KEY,
+    course_id       bigint REFERENCES courses (id) NOT NULL,
+    test_id         bigint REFERENCES tests (id)            DEFAULT NULL,
+    topic           text                                    DEFAULT NULL,
+    due_at          timestamptz                    NOT NULL,
+    late_policy     late_policy_t                  NOT NULL DEFAULT 'reject',
+    late_multiplier double precision               NOT NULL DEFAULT 1,
+    CHECK (test_id IS NULL OR topic IS NULL)
+);
+CREATE UNIQUE INDEX deadlines__scope ON deadlines (course_id, COALESCE(test_id, 0), COALESCE(topic, ''));
+
+DROP TABLE IF EXISTS extensions CASCADE;
+CREATE TABLE IF NOT EXISTS extensions
+(
+    id          bigserial PRIMARY KEY,
+    deadline_id bigint REFERENCES deadlines (id) ON DELETE CASCADE NOT NULL,
+    user_id     bigint REFERENCES users (id)                       NOT NULL,
+    due_at      timestamptz                                        NOT NULL,
+    granted_at  timestamptz                                        NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX extensions__deadline_user ON extensions (deadline_id, user_id);
+CREATE INDEX extensions__user_id ON extensions (user_id);
+
+-- -----------------------------------------------------------------------------
+
+-- Existing commits were submitted when their tasks were enqueued; commits
+-- without a task fall back to the time of the migration.
+ALTER TABLE commits
+    ADD COLUMN submitted_at timestamptz;
+UPDATE commits AS c
+SET submitted_at=t.submitted_at
+FROM (SELECT commit_id, MIN(LEAST(enqueued_at, started_at)) AS submitted_at FROM tasks GROUP BY commit_id) AS t
+WHERE t.commit_id = c.id;
+UPDATE commits
+SET submitted_at=CURRENT_TIMESTAMP
+WHERE submitted_at IS NULL;
+ALTER TABLE commits
+    ALTER COLUMN submitted_at SET DEFAULT CURRENT_TIMESTAMP,
+    ALTER COLUMN submitted_at SET NOT NULL;
+
+-- Checks of late submissions under the reject policy are shown but not graded.
+ALTER TABLE checks
+    ADD COLUMN is_graded boolean NOT NULL DEFAULT TRUE;
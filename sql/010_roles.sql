@@ -0,0 +1,34 @@
+-- -----------------------------------------------------------------------------
+-- Course staff and the log of their actions.
+
+DROP TYPE IF EXISTS role_t CASCADE;
+CREATE TYPE role_t AS ENUM (
+    'instructor',
+    'assistant'
+    );
+
+DROP TABLE IF EXISTS roles CASCADE;
+CREATE TABLE IF NOT EXISTS roles
+(
+    id        bigserial PRIMARY KEY,
+    user_id   bigint REFERENCES users (id)   NOT NULL,
+    course_id bigint REFERENCES courses (id) NOT NULL,
+    role      role_t                         NOT NULL
+);
+CREATE UNIQUE INDEX roles__user_course ON roles (user_id, course_id);
+
+-- -----------------------------------------------------------------------------
+
+DROP TABLE IF EXISTS audit_log CASCADE;
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    id         bigserial PRIMARY KEY,
+    course_id  bigint REFERENCES courses (id) NOT NULL,
+    -- NULL for actions authenticated with the runner token
+    user_id    bigint REFERENCES users (id)            DEFAULT NULL,
+    action     text                           NOT NULL,
+    target     text                           NOT NULL,
+    details    jsonb,
+    created_at timestamptz                    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX audit_log__course_id ON audit_log (course_id, id);
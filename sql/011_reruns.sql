@@ -0,0 +1,12 @@
+-- -----------------------------------------------------------------------------
+-- Re-runs of commits requested by their owners or the course staff.
+
+DROP TABLE IF EXISTS reruns CASCADE;
+CREATE TABLE IF NOT EXISTS reruns
+(
+    id           bigserial PRIMARY KEY,
+    commit_id    bigint REFERENCES commits (id) NOT NULL,
+    user_id      bigint REFERENCES users (id)   NOT NULL,
+    requested_at timestamptz                    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX reruns__user_id ON reruns (user_id, requested_at);
@@ -0,0 +1,11 @@
+-- -----------------------------------------------------------------------------
+-- Course versions: the version is bumped whenever tests or baselines change,
+-- checks remember the version they were produced by.
+
+ALTER TABLE courses
+    ADD COLUMN version     bigint NOT NULL DEFAULT 1,
+    -- digest of test definitions and baselines of the current version
+    ADD COLUMN fingerprint text   NOT NULL DEFAULT '';
+
+ALTER TABLE checks
+    ADD COLUMN course_version bigint NOT NULL DEFAULT 1;
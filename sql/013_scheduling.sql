@@ -0,0 +1,18 @@
+-- -----------------------------------------------------------------------------
+-- Tasks are dequeued by priority, e.g. regrades go after pushes.
+
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS priority int NOT NULL DEFAULT 0;
+DROP INDEX IF EXISTS "tasks__enqueued_idx";
+CREATE INDEX "tasks__enqueued_idx" ON tasks (priority DESC, enqueued_at) WHERE status = 'enqueued';
+
+-- -----------------------------------------------------------------------------
+-- Enqueued tasks superseded by a newer commit of the same user are skipped.
+
+ALTER TYPE task_status_t ADD VALUE IF NOT EXISTS 'skipped';
+
+-- Only tasks of pushes are superseded, re-runs and regrades are kept.
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS origin text NOT NULL DEFAULT 'push';
+
+CREATE INDEX commits__user_course ON commits (user_id, course_id);
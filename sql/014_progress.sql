@@ -0,0 +1,51 @@
+-- -----------------------------------------------------------------------------
+-- Stages reported by runners while a task is being executed. They are shown
+-- until the task is finished and its checks are saved.
+
+CREATE TABLE IF NOT EXISTS progress
+(
+    id          bigserial PRIMARY KEY,
+    task_id     uuid           NOT NULL REFERENCES tasks (id) ON DELETE CASCADE,
+    name        text           NOT NULL,
+    status      check_status_t NOT NULL,
+    output      text           NOT NULL,
+    results     jsonb                   DEFAULT NULL,
+    is_cached   boolean                 DEFAULT FALSE,
+    reported_at timestamptz    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX progress__task_id ON progress (task_id);
+
+-- -----------------------------------------------------------------------------
+-- Notify long-polling readers about reported stages and status changes of
+-- tasks. The payload is the commit id.
+
+CREATE OR REPLACE FUNCTION notify_progress_reported() RETURNS trigger AS
+$$
+BEGIN
+    PERFORM pg_notify('progress', (SELECT commit_id::text FROM tasks WHERE id = NEW.task_id));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS progress__notify_reported ON progress;
+CREATE TRIGGER progress__notify_reported
+    AFTER INSERT
+    ON progress
+    FOR EACH ROW
+EXECUTE PROCEDURE notify_progress_reported();
+
+CREATE OR REPLACE FUNCTION notify_task_status() RETURNS trigger AS
+$$
+BEGIN
+    PERFORM pg_notify('progress', NEW.commit_id::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tasks__notify_status ON tasks;
+CREATE TRIGGER tasks__notify_status
+    AFTER UPDATE OF status
+    ON tasks
+    FOR EACH ROW
+    WHEN (OLD.status IS DISTINCT FROM NEW.status)
+EXECUTE PROCEDURE notify_task_status();
@@ -0,0 +1,9 @@
+-- -----------------------------------------------------------------------------
+-- Outputs exceeding the runner limit are truncated, full logs are kept in S3
+-- under the given keys.
+
+ALTER TABLE runs
+    ADD COLUMN log_key text DEFAULT NULL;
+
+ALTER TABLE checks
+    ADD COLUMN log_key text DEFAULT NULL;
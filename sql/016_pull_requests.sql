@@ -0,0 +1,5 @@
+-- -----------------------------------------------------------------------------
+-- Commits checked on behalf of pull requests get a review with the results.
+
+ALTER TABLE commits
+    ADD COLUMN pull_request int DEFAULT NULL;
@@ -0,0 +1,31 @@
+-- -----------------------------------------------------------------------------
+-- Webhook deliveries received from Github. Deliveries are processed once and
+-- can be replayed by the course staff. Processed and ignored deliveries are
+-- pruned by age.
+
+DROP TYPE IF EXISTS delivery_status_t CASCADE;
+CREATE TYPE delivery_status_t AS ENUM (
+    'received',
+    'processed',
+    'ignored',
+    'failed'
+    );
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id            bigserial PRIMARY KEY,
+    delivery_id   text              NOT NULL UNIQUE,
+    event         text              NOT NULL,
+    headers       jsonb             NOT NULL,
+    payload       jsonb             NOT NULL,
+    repository_id bigint                     DEFAULT NULL,
+    status        delivery_status_t NOT NULL DEFAULT 'received',
+    error         text                       DEFAULT NULL,
+    attempts      int               NOT NULL DEFAULT 0,
+    received_at   timestamptz       NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- when the delivery has been taken for processing the last time
+    claimed_at    timestamptz       NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    processed_at  timestamptz                DEFAULT NULL
+);
+CREATE INDEX webhook_deliveries__repository_id ON webhook_deliveries (repository_id);
+CREATE INDEX webhook_deliveries__received_at ON webhook_deliveries (received_at);
@@ -0,0 +1,15 @@
+-- -----------------------------------------------------------------------------
+-- Webhooks rejected because of a missing or invalid signature. Payloads are
+-- not trusted, so only their sizes are kept.
+
+CREATE TABLE IF NOT EXISTS webhook_rejections
+(
+    id           bigserial PRIMARY KEY,
+    delivery_id  text        NOT NULL,
+    event        text        NOT NULL,
+    reason       text        NOT NULL,
+    remote_addr  text        NOT NULL,
+    headers      jsonb       NOT NULL,
+    payload_size int         NOT NULL,
+    received_at  timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
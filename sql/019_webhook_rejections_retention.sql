@@ -0,0 +1,4 @@
+-- -----------------------------------------------------------------------------
+-- Rejected webhooks are pruned by age.
+
+CREATE INDEX webhook_rejections__received_at ON webhook_rejections (received_at);